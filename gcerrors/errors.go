@@ -66,6 +66,10 @@ const (
 
 	// The operation timed out.
 	DeadlineExceeded ErrorCode = gcerr.DeadlineExceeded
+
+	// The service is currently unavailable, typically because of a transient
+	// condition that may be corrected by retrying.
+	Unavailable ErrorCode = gcerr.Unavailable
 )
 
 // Code returns the ErrorCode of err if it, or some error it wraps, is an *Error.
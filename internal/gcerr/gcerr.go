@@ -69,6 +69,10 @@ const (
 
 	// The operation timed out.
 	DeadlineExceeded ErrorCode = 11
+
+	// The service is currently unavailable, typically because of a transient
+	// condition that may be corrected by retrying.
+	Unavailable ErrorCode = 12
 )
 
 // When adding a new error code, try to use the names defined in google.golang.org/grpc/codes.
@@ -35,7 +35,7 @@ func ExampleCreateTopic() {
 	}
 	defer nc.Close()
 
-	pt := natspubsub.CreateTopic(nc, "go-cloud.example.send")
+	pt := natspubsub.CreateTopic(nc, "go-cloud.example.send", nil)
 
 	err = pt.Send(ctx, &pubsub.Message{Body: []byte("example message")})
 }
@@ -52,7 +52,7 @@ func ExampleCreateSubscription() {
 	}
 	defer nc.Close()
 
-	sub := natspubsub.CreateSubscription(nc, "go-cloud.example.send")
+	sub := natspubsub.CreateSubscription(nc, "go-cloud.example.send", nil)
 
 	// Now we can use sub to receive messages.
 	msg, err := sub.Receive(ctx)
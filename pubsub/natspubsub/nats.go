@@ -15,7 +15,39 @@
 // Package natspubsub provides a pubsub implementation for NATS.io.
 // Use CreateTopic to construct a *pubsub.Topic, and/or CreateSubscription
 // to construct a *pubsub.Subscription. This package uses msgPack and the
-// ugorji driver to encode and decode driver.Message to []byte.
+// ugorji driver to encode and decode driver.Message to []byte, unless
+// TopicOptions.Encoding selects JSON or gob.
+//
+// URLs
+//
+// For pubsub.OpenTopic and pubsub.OpenSubscription, natspubsub registers
+// for the scheme "nats". The host of the URL is the server to dial and the
+// path is the subject, as in "nats://myserver:4222/mysubject"; topics and
+// subscriptions opened for the same server share a single connection, which
+// is kept until CloseCachedConnections is called.
+// To customize the URL opener, or for more details on the URL format,
+// see URLOpener.
+// See https://godoc.org/gocloud.dev#URLs for background information.
+//
+// Metadata
+//
+// Metadata keys starting with "nats." are reserved for the driver; sending a
+// message with such a key fails with an error whose code is InvalidArgument.
+// The only exception is "nats.subject", which sets the subject of the messages
+// sent with a topic created by CreateDynamicTopic. Subscriptions with a
+// SubjectPattern set it to the subject a message was received on, so that a
+// received message can be sent again with its metadata: topics that are not
+// dynamic drop the key, while a dynamic topic sends the message back to the
+// subject it was received on, unless the key is changed first.
+//
+// Ordering
+//
+// A subscription that is not part of a queue group receives the messages sent
+// to its subject by a topic in the order in which they were sent, when they
+// are received from a single goroutine: ReceiveBatch returns the messages
+// buffered by NATS in order, however many it returns at once. Sends that run
+// concurrently, for example with MaxConcurrentSends, are not ordered with
+// respect to each other.
 //
 // As
 //
@@ -23,26 +55,230 @@
 //  - Topic: *nats.Conn
 //  - Subscription: *nats.Subscription
 //  - Message: *nats.Msg
+//  - Error: *BatchValidationError and *MessageError, for Topic.Send
 
 package natspubsub // import "gocloud.dev/pubsub/natspubsub"
 
 import (
+	"bytes"
+	"container/list"
 	"context"
+	"encoding/gob"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net/url"
+	"path"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/nats-io/go-nats"
 	"github.com/ugorji/go/codec"
 	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/gcerr"
 	"gocloud.dev/pubsub"
 	"gocloud.dev/pubsub/driver"
 )
 
 var errNotInitialized = errors.New("natspubsub: topic not initialized")
 
+// reservedPrefix is the prefix of the metadata keys reserved for the driver.
+const reservedPrefix = "nats."
+
+var errNotEncoded = errors.New("natspubsub: message has no envelope")
+
+var errReservedMetadata = errors.New("natspubsub: metadata keys starting with " + reservedPrefix + " are reserved")
+
+// subjectKey is the metadata key holding the subject of the messages sent with
+// a dynamic topic.
+const subjectKey = reservedPrefix + "subject"
+
+var errInvalidSubject = errors.New("natspubsub: missing or invalid " + subjectKey + " metadata")
+
+func init() {
+	pubsub.DefaultURLMux().RegisterTopic(Scheme, defaultDialer)
+	pubsub.DefaultURLMux().RegisterSubscription(Scheme, defaultDialer)
+}
+
+var defaultDialer = new(lazyDialer)
+
+// CloseCachedConnections closes the connections dialed for the topics and
+// subscriptions opened by URL on pubsub.DefaultURLMux, and removes them from
+// the cache, so that they don't outlive their topics and subscriptions, for
+// example on shutdown or in tests that open many URLs. The topics and
+// subscriptions opened before stop working; URLs opened afterwards dial
+// again.
+func CloseCachedConnections() {
+	defaultDialer.close()
+}
+
+// lazyDialer opens URLs like "nats://myserver:4222/mysubject", dialing the
+// server in the URL on first use and sharing its connection among the topics
+// and subscriptions opened for it.
+type lazyDialer struct {
+	mu sync.Mutex
+	// conns maps server addresses, with their user info, to connections.
+	conns map[string]*nats.Conn
+}
+
+// conn returns the connection to the server of u, dialing it if there is none
+// or it was closed.
+func (o *lazyDialer) conn(u *url.URL) (*nats.Conn, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing server address, want nats://host:port/subject")
+	}
+	server := url.URL{Scheme: Scheme, User: u.User, Host: u.Host}
+	addr := server.String()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if nc := o.conns[addr]; nc != nil && !nc.IsClosed() {
+		return nc, nil
+	}
+	nc, err := Dial(addr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %v", redactURL(addr), err)
+	}
+	if o.conns == nil {
+		o.conns = map[string]*nats.Conn{}
+	}
+	o.conns[addr] = nc
+	return nc, nil
+}
+
+// close closes the cached connections and empties the cache.
+func (o *lazyDialer) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for addr, nc := range o.conns {
+		nc.Close()
+		delete(o.conns, addr)
+	}
+}
+
+// opener returns the URLOpener for the server of u, and u without the server.
+func (o *lazyDialer) opener(u *url.URL) (*URLOpener, *url.URL, error) {
+	nc, err := o.conn(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	u2 := *u
+	u2.User, u2.Host = nil, ""
+	return &URLOpener{Connection: nc}, &u2, nil
+}
+
+func (o *lazyDialer) OpenTopicURL(ctx context.Context, u *url.URL) (*pubsub.Topic, error) {
+	opener, u2, err := o.opener(u)
+	if err != nil {
+		return nil, fmt.Errorf("open topic %v: %v", redactURL(u.String()), err)
+	}
+	return opener.OpenTopicURL(ctx, u2)
+}
+
+func (o *lazyDialer) OpenSubscriptionURL(ctx context.Context, u *url.URL) (*pubsub.Subscription, error) {
+	opener, u2, err := o.opener(u)
+	if err != nil {
+		return nil, fmt.Errorf("open subscription %v: %v", redactURL(u.String()), err)
+	}
+	return opener.OpenSubscriptionURL(ctx, u2)
+}
+
+// Scheme is the URL scheme natspubsub registers its URLOpeners under on
+// pubsub.DefaultMux. The registered opener dials the server named in the URL,
+// as in "nats://myserver:4222/mysubject", and reuses the connection for later
+// URLs naming the same server.
+const Scheme = "nats"
+
+// URLOpener opens NATS URLs like "nats://mysubject" with an existing
+// connection. The URL Host + Path are used as the subject.
+//
+// The subject may be a template, expanded with the Vars of the connection;
+// as braces are not allowed in URL hosts, templates go in the path, as in
+// "nats:///events.{env}.orders". Opening a URL whose template has a
+// placeholder without a variable fails.
+//
+// For subscriptions, the "queue" query parameter sets
+// SubscriptionOptions.Queue. No other query parameters are supported.
+type URLOpener struct {
+	// Connection to use for communication with the server.
+	Connection *nats.Conn
+	// TopicOptions specifies the options to pass to CreateTopic.
+	TopicOptions TopicOptions
+	// SubscriptionOptions specifies the options to pass to CreateSubscription.
+	SubscriptionOptions SubscriptionOptions
+}
+
+// OpenTopicURL opens a pubsub.Topic based on u.
+func (o *URLOpener) OpenTopicURL(ctx context.Context, u *url.URL) (*pubsub.Topic, error) {
+	for param := range u.Query() {
+		return nil, fmt.Errorf("open topic %v: unknown query parameter %s", u, param)
+	}
+	subject, err := urlSubject(o.Connection, u)
+	if err != nil {
+		return nil, fmt.Errorf("open topic %v: %v", u, err)
+	}
+	return CreateTopic(o.Connection, subject, &o.TopicOptions), nil
+}
+
+// OpenSubscriptionURL opens a pubsub.Subscription based on u.
+func (o *URLOpener) OpenSubscriptionURL(ctx context.Context, u *url.URL) (*pubsub.Subscription, error) {
+	opts := o.SubscriptionOptions
+	for param, values := range u.Query() {
+		switch param {
+		case "queue":
+			opts.Queue = values[0]
+		default:
+			return nil, fmt.Errorf("open subscription %v: unknown query parameter %s", u, param)
+		}
+	}
+	subject, err := urlSubject(o.Connection, u)
+	if err != nil {
+		return nil, fmt.Errorf("open subscription %v: %v", u, err)
+	}
+	return CreateSubscription(o.Connection, subject, &opts), nil
+}
+
+// urlSubject returns the subject named by the Host + Path of u, expanded
+// with the Vars of nc.
+func urlSubject(nc *nats.Conn, u *url.URL) (string, error) {
+	subject := strings.TrimPrefix(path.Join(u.Host, u.Path), "/")
+	if subject == "" {
+		return "", errors.New("missing subject")
+	}
+	return ExpandSubject(nc, subject)
+}
+
 type topic struct {
 	nc   *nats.Conn
 	subj string
+	// err is the error of every SendBatch, set if subj is not a valid
+	// subject to publish to.
+	err error
+	// dynamic is true if the subject of every message is read from its
+	// metadata; see CreateDynamicTopic.
+	dynamic bool
+	// sem limits the number of concurrent calls to SendBatch if it is not
+	// nil; see TopicOptions.MaxConcurrentSends.
+	sem chan struct{}
+	// publish publishes a message; it defaults to nc.Publish and is swapped
+	// in tests.
+	publish  func(subj string, data []byte) error
+	encoding Encoding
+	// retries is the number of times a publish failing with a transient
+	// error is retried; see TopicOptions.PublishRetries.
+	retries int
+	// partitions and partitionKey shard messages over subjects; see
+	// TopicOptions.PartitionKeyFunc.
+	partitions   int
+	partitionKey func(*driver.Message) string
+	// validateUpfront is TopicOptions.ValidateBatchUpfront.
+	validateUpfront bool
 }
 
 // For encoding we use msgpack from github.com/ugorji/go.
@@ -69,17 +305,710 @@ type encMsg struct {
 	Metadata map[string]string `codec:",omitempty"`
 }
 
+// Encoding is the codec of the envelope holding the body and metadata of
+// messages sent by a topic.
+type Encoding int
+
+const (
+	// EncodingMsgpack encodes envelopes with msgpack. It is the default, and
+	// the only encoding understood by subscribers older than the other
+	// encodings.
+	EncodingMsgpack Encoding = iota
+	// EncodingJSON encodes envelopes as JSON, for consumers written in other
+	// languages.
+	EncodingJSON
+	// EncodingGob encodes envelopes with encoding/gob.
+	EncodingGob
+)
+
+// envelopeMagic starts the envelopes that are not encoded with msgpack. 0xc1
+// is never used in msgpack, so it cannot start a msgpack envelope. It is
+// followed by a format descriptor made of descriptorMarker and the version of
+// the format, the codec and the compression of the envelope, or, in envelopes
+// written before descriptors were added, by the codec alone.
+const envelopeMagic = 0xc1
+
+// descriptorMarker starts the format descriptor following envelopeMagic.
+const descriptorMarker = 'd'
+
+// envelopeVersion is the version of the envelope format written by topics.
+// Subscriptions reject envelopes with a greater version.
+const envelopeVersion = 1
+
+// Codec bytes of format descriptors.
+const (
+	codecMsgpack = 'm'
+	codecJSON    = 'j'
+	codecGob     = 'g'
+)
+
+// Compression bytes of format descriptors.
+const (
+	compressionNone = 0
+)
+
+// unsupportedFormatError is returned when receiving an envelope whose format
+// descriptor is well-formed, but uses a format that the subscription does not
+// support, for example one written by a newer version of the driver.
+type unsupportedFormatError struct {
+	version, codec, compression byte
+	what                        string
+}
+
+func (e *unsupportedFormatError) Error() string {
+	return fmt.Sprintf("natspubsub: unsupported envelope %s (format version %d, codec %q, compression %d)", e.what, e.version, e.codec, e.compression)
+}
+
+// encodeEnvelope stores in b[:0] the envelope of em encoded with e, which is
+// not EncodingMsgpack, and returns it.
+func encodeEnvelope(b []byte, e Encoding, em *encMsg) ([]byte, error) {
+	header := func(codec byte) []byte {
+		return append(b[:0], envelopeMagic, descriptorMarker, envelopeVersion, codec, compressionNone)
+	}
+	switch e {
+	case EncodingJSON:
+		data, err := json.Marshal(em)
+		if err != nil {
+			return nil, err
+		}
+		return append(header(codecJSON), data...), nil
+	case EncodingGob:
+		buf := bytes.NewBuffer(header(codecGob))
+		if err := gob.NewEncoder(buf).Encode(em); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("natspubsub: unknown encoding %d", e)
+}
+
+// decodeEnvelope decodes the envelope in data into dm, detecting its codec.
+// It returns an *unsupportedFormatError if the envelope has a format
+// descriptor for a format it does not support.
+func decodeEnvelope(data []byte, dm *driver.Message) error {
+	if len(data) < 2 || data[0] != envelopeMagic {
+		return codec.NewDecoderBytes(data, &mh).Decode(dm)
+	}
+	c, payload := data[1], data[2:]
+	if c == descriptorMarker {
+		if len(data) < 5 {
+			return errors.New("natspubsub: truncated envelope format descriptor")
+		}
+		version, compression := data[2], data[4]
+		c, payload = data[3], data[5:]
+		fe := &unsupportedFormatError{version: version, codec: c, compression: compression}
+		switch {
+		case version == 0 || version > envelopeVersion:
+			fe.what = "format version"
+			return fe
+		case compression != compressionNone:
+			fe.what = "compression"
+			return fe
+		case c != codecMsgpack && c != codecJSON && c != codecGob:
+			fe.what = "codec"
+			return fe
+		}
+	}
+	var em encMsg
+	var err error
+	switch c {
+	case codecMsgpack:
+		err = codec.NewDecoderBytes(payload, &mh).Decode(&em)
+	case codecJSON:
+		err = json.Unmarshal(payload, &em)
+	case codecGob:
+		err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&em)
+	default:
+		err = fmt.Errorf("natspubsub: unknown envelope codec %q", c)
+	}
+	if err != nil {
+		return err
+	}
+	dm.Body, dm.Metadata = em.Body, em.Metadata
+	return nil
+}
+
+// ConnectionOptions controls how Dial connects to NATS.
+type ConnectionOptions struct {
+	// CustomDialer, if set, is used to open the network connections to the
+	// servers, for example to go through a proxy or to connect in-process in
+	// tests. Defaults to dialing TCP.
+	CustomDialer nats.CustomDialer
+
+	// UserJWTCallback and SignatureCallback, if set, authenticate the
+	// connection with a user JWT, as NATS 2.0 accounts such as NGS do. They
+	// are called on every connect and reconnect, so that a long-lived
+	// connection stays authenticated as its credentials rotate:
+	// UserJWTCallback returns the current JWT, and SignatureCallback signs the
+	// nonce sent by the server with the private key of the user. Both must be
+	// set.
+	UserJWTCallback   nats.UserJWTHandler
+	SignatureCallback nats.SignatureHandler
+
+	// Logger, if set, receives messages about the connection being
+	// established, lost, re-established and closed, and about asynchronous
+	// errors. Credentials in server URLs are redacted.
+	Logger Logger
+
+	// OnPermissionError, if set, is called with the permission violations
+	// reported by the server, which happen when the account of the connection
+	// is not allowed to publish or subscribe to a subject. The server reports
+	// them asynchronously, so the Send that published to the subject succeeds;
+	// the violation is also returned by the next Send to the subject, or the
+	// next Receive from it, as an error whose code is PermissionDenied.
+	OnPermissionError func(error)
+
+	// Vars are the variables of the subject templates of the connection, for
+	// example {"env": "prod"} to expand "events.{env}.orders" to
+	// "events.prod.orders". The subjects given to CreateTopic,
+	// CreateSubscription and URLOpener are expanded, as with ExpandSubject.
+	Vars map[string]string
+
+	// ReconnectJitter, if positive, is the maximum of a random offset added
+	// to the wait between reconnect attempts, so that a fleet of services
+	// that lost the same server doesn't reconnect all at once. The offset is
+	// chosen once when the connection is dialed, and then used for every
+	// attempt of the connection: it spreads the reconnects of different
+	// connections, not of the attempts of one.
+	ReconnectJitter time.Duration
+
+	// RandomizeServers controls whether the connection tries the servers of
+	// the URL in a random order, rather than in order, when connecting and
+	// reconnecting. Randomizing spreads the connections of a fleet over the
+	// servers of a cluster. Defaults to true when nil.
+	RandomizeServers *bool
+}
+
+// Logger receives log messages. *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Dial connects to the NATS servers in url, a comma-separated list of server
+// URLs such as "nats://127.0.0.1:4222". opts may be nil.
+func Dial(url string, opts *ConnectionOptions) (*nats.Conn, error) {
+	if opts == nil {
+		opts = &ConnectionOptions{}
+	}
+	if (opts.UserJWTCallback == nil) != (opts.SignatureCallback == nil) {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "natspubsub: UserJWTCallback and SignatureCallback must be set together")
+	}
+	state := &connState{
+		vars:      opts.Vars,
+		reconnect: reconnectHandlers{fns: map[*nats.Subscription]func(){}},
+	}
+	nc, err := nats.Connect(url, dialOptions(opts, state)...)
+	if err != nil {
+		return nil, err
+	}
+	conns.Store(nc, state)
+	if opts.Logger != nil {
+		opts.Logger.Printf("natspubsub: connected to %s", redactURL(nc.ConnectedUrl()))
+	}
+	return nc, nil
+}
+
+// dialOptions returns the options of nats.Connect for opts. The handlers it
+// installs record the state of the connection in state.
+func dialOptions(opts *ConnectionOptions, state *connState) []nats.Option {
+	var natsOpts []nats.Option
+	if opts.ReconnectJitter > 0 {
+		jitter := time.Duration(rand.Int63n(int64(opts.ReconnectJitter) + 1))
+		natsOpts = append(natsOpts, nats.ReconnectWait(nats.DefaultReconnectWait+jitter))
+	}
+	if opts.RandomizeServers != nil && !*opts.RandomizeServers {
+		natsOpts = append(natsOpts, nats.DontRandomize())
+	}
+	if opts.CustomDialer != nil {
+		natsOpts = append(natsOpts, nats.SetCustomDialer(opts.CustomDialer))
+	}
+	if opts.UserJWTCallback != nil {
+		natsOpts = append(natsOpts, nats.UserJWT(opts.UserJWTCallback, opts.SignatureCallback))
+	}
+	l := opts.Logger
+	if l != nil {
+		natsOpts = append(natsOpts, nats.DisconnectHandler(func(nc *nats.Conn) {
+			l.Printf("natspubsub: disconnected: %v", nc.LastError())
+		}))
+	}
+	natsOpts = append(natsOpts,
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			if l != nil {
+				l.Printf("natspubsub: reconnected to %s", redactURL(nc.ConnectedUrl()))
+			}
+			state.reconnect.call()
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			conns.Delete(nc)
+			if l != nil {
+				l.Printf("natspubsub: connection closed")
+			}
+		}),
+		nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
+			if l != nil {
+				if sub != nil {
+					l.Printf("natspubsub: error on subscription to %q: %v", sub.Subject, err)
+				} else {
+					l.Printf("natspubsub: error: %v", err)
+				}
+			}
+			if perr := parsePermissionError(err); perr != nil {
+				state.perms.add(perr)
+				if opts.OnPermissionError != nil {
+					opts.OnPermissionError(perr)
+				}
+			}
+		}),
+	)
+	return natsOpts
+}
+
+// CheckHealth reports whether nc is connected to a NATS server, and returns
+// its round-trip time to the server, measured by flushing the connection. It
+// returns an error whose code is Unavailable if nc is not connected, for
+// example while it is reconnecting or draining. Use gcerrors.Code to get the
+// category of the error.
+func CheckHealth(ctx context.Context, nc *nats.Conn) (rtt time.Duration, err error) {
+	if status := nc.Status(); status != nats.CONNECTED {
+		return 0, gcerr.Newf(gcerr.Unavailable, nil, "natspubsub: connection is not connected (status %d)", status)
+	}
+	start := time.Now()
+	if err := nc.FlushWithContext(ctx); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return 0, ctxErr
+		}
+		return 0, gcerr.New(gcerr.Unavailable, err, 1, "natspubsub: flushing the connection failed")
+	}
+	return time.Since(start), nil
+}
+
+// redactURL returns rawurl with the password in it, if any, redacted, for
+// logging.
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.User == nil {
+		return rawurl
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// subjectVar matches the placeholders of subject templates.
+var subjectVar = regexp.MustCompile(`\{[^{}]*\}`)
+
+// ExpandSubject returns the subject template with each "{name}" placeholder
+// replaced by the variable name in the Vars of the ConnectionOptions nc was
+// dialed with, so that a single configuration can serve several environments.
+// CreateTopic, CreateSubscription and URLOpener expand the templates they are
+// given; a topic or subscription whose template has a placeholder without a
+// variable fails with an error whose code is FailedPrecondition when used.
+// ExpandSubject fails with an error whose code is InvalidArgument if a
+// placeholder has no variable.
+func ExpandSubject(nc *nats.Conn, template string) (string, error) {
+	var vars map[string]string
+	if v, ok := conns.Load(nc); ok {
+		vars = v.(*connState).vars
+	}
+	return expandSubject(template, vars)
+}
+
+func expandSubject(template string, vars map[string]string) (string, error) {
+	var missing []string
+	subj := subjectVar.ReplaceAllStringFunc(template, func(p string) string {
+		name := p[1 : len(p)-1]
+		v, ok := vars[name]
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "natspubsub: subject template %q has no variables %q", template, missing)
+	}
+	return subj, nil
+}
+
+// connState is the state the driver keeps about a connection created by Dial.
+type connState struct {
+	perms permissionErrors
+	// vars are the variables of subject templates; see ConnectionOptions.Vars.
+	vars map[string]string
+	// reconnect holds the SubscriptionOptions.OnReconnect of the
+	// subscriptions of the connection.
+	reconnect reconnectHandlers
+}
+
+// reconnectHandlers holds the functions to call when a connection created by
+// Dial reconnects, keyed by the subscription that registered them. The
+// handler of the connection is installed once by Dial, so that subscriptions
+// never change the options of the connection.
+type reconnectHandlers struct {
+	mu  sync.Mutex
+	fns map[*nats.Subscription]func()
+}
+
+// add registers fn for sub, and forgets the functions of subscriptions that
+// were unsubscribed since.
+func (h *reconnectHandlers) add(sub *nats.Subscription, fn func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.prune()
+	h.fns[sub] = fn
+}
+
+// remove forgets the function of sub, if any.
+func (h *reconnectHandlers) remove(sub *nats.Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.fns, sub)
+}
+
+// call calls the functions of the subscriptions that are still subscribed.
+func (h *reconnectHandlers) call() {
+	h.mu.Lock()
+	h.prune()
+	fns := make([]func(), 0, len(h.fns))
+	for _, fn := range h.fns {
+		fns = append(fns, fn)
+	}
+	h.mu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// prune forgets the functions of unsubscribed subscriptions. h.mu must be
+// held.
+func (h *reconnectHandlers) prune() {
+	for sub := range h.fns {
+		if !sub.IsValid() {
+			delete(h.fns, sub)
+		}
+	}
+}
+
+// forgetOnReconnect forgets the SubscriptionOptions.OnReconnect registered
+// by sub on its connection, if any.
+func forgetOnReconnect(sub *nats.Subscription) {
+	conns.Range(func(_, v interface{}) bool {
+		v.(*connState).reconnect.remove(sub)
+		return true
+	})
+}
+
+// conns maps the connections created by Dial to their *connState. Connections
+// are removed when they are closed.
+var conns sync.Map
+
+// permissionError is a permission violation reported by the server, when the
+// account of a connection is not allowed to publish or subscribe to a subject.
+type permissionError struct {
+	op   string // "publish" or "subscription"
+	subj string
+	err  error
+}
+
+func (e *permissionError) Error() string {
+	return fmt.Sprintf("natspubsub: permission denied for %s to %q: %v", e.op, e.subj, e.err)
+}
+
+// permissionViolation matches the permission violations sent by the server.
+var permissionViolation = regexp.MustCompile(`(?i)permissions violation for (publish|subscription) to "(.*)"`)
+
+// parsePermissionError returns the permission violation reported by err, or
+// nil if err is not one.
+func parsePermissionError(err error) *permissionError {
+	if err == nil {
+		return nil
+	}
+	m := permissionViolation.FindStringSubmatch(err.Error())
+	if m == nil {
+		return nil
+	}
+	return &permissionError{op: strings.ToLower(m[1]), subj: m[2], err: err}
+}
+
+// maxPermissionErrors is the maximum number of permission violations held
+// per connection. Subjects that are never used again, such as those of
+// dynamic topics, would otherwise hold theirs forever.
+const maxPermissionErrors = 256
+
+// permissionErrors holds the latest maxPermissionErrors permission violations
+// reported on a connection created by Dial, until they are returned by a send
+// to, or a receive from, their subject. The zero value holds none.
+type permissionErrors struct {
+	mu sync.Mutex
+	// errs maps the op and subject of the violations to their element in
+	// order, which holds them from the oldest to the latest reported.
+	errs  map[string]*list.Element
+	order *list.List
+}
+
+func (p *permissionErrors) add(err *permissionError) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.errs == nil {
+		p.errs = map[string]*list.Element{}
+		p.order = list.New()
+	}
+	key := err.op + " " + err.subj
+	if e, ok := p.errs[key]; ok {
+		e.Value = err
+		p.order.MoveToBack(e)
+		return
+	}
+	p.errs[key] = p.order.PushBack(err)
+	if p.order.Len() > maxPermissionErrors {
+		oldest := p.order.Remove(p.order.Front()).(*permissionError)
+		delete(p.errs, oldest.op+" "+oldest.subj)
+	}
+}
+
+// take returns and forgets the permission violation of op on subj, if any.
+func (p *permissionErrors) take(op, subj string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.errs[op+" "+subj]
+	if !ok {
+		return nil
+	}
+	delete(p.errs, op+" "+subj)
+	return p.order.Remove(e).(*permissionError)
+}
+
+// takePermissionError returns and forgets the permission violation of op on
+// subj reported on nc, if any.
+func takePermissionError(nc *nats.Conn, op, subj string) error {
+	v, ok := conns.Load(nc)
+	if !ok {
+		return nil
+	}
+	return v.(*connState).perms.take(op, subj)
+}
+
+// TopicOptions sets options for constructing a *pubsub.Topic backed by NATS.
+type TopicOptions struct {
+	// MaxConcurrentSends, if positive, is the maximum number of batches of
+	// messages published concurrently. Sends beyond it wait for an earlier
+	// one to finish, or for their context to be done, which bounds the load
+	// put on the server by bursty publishers.
+	MaxConcurrentSends int
+
+	// Encoding is the codec of the envelope of messages that have metadata.
+	// Subscriptions detect it, so messages sent with different encodings can
+	// be mixed on a subject. Defaults to EncodingMsgpack.
+	Encoding Encoding
+
+	// PublishRetries is the number of times the publish of a message is
+	// retried when it fails with a transient error, such as the reconnect
+	// buffer of the connection being full while it reconnects. Retries back
+	// off from 10ms and stop when the context of the send is done. Permanent
+	// errors, such as a bad subject or a payload that is too large, are not
+	// retried. Defaults to 0, for no retries.
+	PublishRetries int
+
+	// PartitionKeyFunc, if set with a positive Partitions, shards the
+	// messages of the topic over Partitions subjects: a message whose key is
+	// k is sent to the subject PartitionSubject(subject, i), where i is
+	// derived from a hash of k. Messages with the same key are thus always
+	// sent to the same partition, in order, so that subscribing to each
+	// partition with a single subscriber preserves the order of the messages
+	// of each key while spreading the keys over the subscribers.
+	PartitionKeyFunc func(*driver.Message) string
+
+	// Partitions is the number of partitions of PartitionKeyFunc.
+	Partitions int
+
+	// ValidateBatchUpfront makes the topic check every message of a batch
+	// before publishing any of them. If some messages are invalid, for
+	// example because they are too large or have an invalid subject, the
+	// batch fails with a *BatchValidationError listing them, and none of its
+	// messages are published. Otherwise, a batch is published until its first
+	// invalid message, if any.
+	ValidateBatchUpfront bool
+}
+
+// BatchValidationError is the error of a batch of a topic with
+// ValidateBatchUpfront that has invalid messages. Get it from the error of
+// Send with ErrorAs. Its code is InvalidArgument.
+type BatchValidationError struct {
+	// Items are the invalid messages, in the order of the batch.
+	Items []BatchValidationItem
+}
+
+// BatchValidationItem is an invalid message of a batch.
+type BatchValidationItem struct {
+	// Index is the index of the message in the batch.
+	Index int
+	// Err is the reason the message is invalid.
+	Err error
+}
+
+func (e *BatchValidationError) Error() string {
+	msgs := make([]string, len(e.Items))
+	for i, item := range e.Items {
+		msgs[i] = fmt.Sprintf("message %d: %v", item.Index, item.Err)
+	}
+	return fmt.Sprintf("natspubsub: %d invalid messages in batch: %s", len(e.Items), strings.Join(msgs, "; "))
+}
+
+// PartitionSubject returns the subject of partition i of the messages sent to
+// subject by a topic with a PartitionKeyFunc, for use with CreateSubscription.
+// Partitions are numbered from 0.
+func PartitionSubject(subject string, i int) string {
+	return subject + "." + strconv.Itoa(i)
+}
+
+// partitionSubject returns the subject the message m to subj is sent to.
+func (t *topic) partitionSubject(subj string, m *driver.Message) string {
+	if t.partitionKey == nil || t.partitions <= 0 {
+		return subj
+	}
+	h := fnv.New32a()
+	io.WriteString(h, t.partitionKey(m))
+	return PartitionSubject(subj, int(h.Sum32()%uint32(t.partitions)))
+}
+
 // CreateTopic returns a *pubsub.Topic for use with NATS.
-// We delay checking for the proper syntax here.
+// topicName is the subject to publish to; it may not contain wildcards.
+// Sending with a topic whose subject is malformed fails with an error whose
+// code is FailedPrecondition, without contacting the server.
 // For more info, see https://nats.io/documentation/writing_applications/subjects
-func CreateTopic(nc *nats.Conn, topicName string) *pubsub.Topic {
-	return pubsub.NewTopic(createTopic(nc, topicName), nil)
+// opts may be nil.
+func CreateTopic(nc *nats.Conn, topicName string, opts *TopicOptions) *pubsub.Topic {
+	return pubsub.NewTopic(createTopic(nc, topicName, opts), nil)
 }
 
 // createTopic returns the driver for CreateTopic. This function exists so the test
 // harness can get the driver interface implementation if it needs to.
-func createTopic(nc *nats.Conn, topicName string) driver.Topic {
-	return &topic{nc, topicName}
+func createTopic(nc *nats.Conn, topicName string, opts *TopicOptions) driver.Topic {
+	return newTopic(nc, topicName, opts)
+}
+
+func newTopic(nc *nats.Conn, topicName string, opts *TopicOptions) *topic {
+	if opts == nil {
+		opts = &TopicOptions{}
+	}
+	t := &topic{
+		nc:           nc,
+		subj:         topicName,
+		encoding:     opts.Encoding,
+		retries:      opts.PublishRetries,
+		partitions:   opts.Partitions,
+		partitionKey: opts.PartitionKeyFunc,
+
+		validateUpfront: opts.ValidateBatchUpfront,
+	}
+	t.subj, t.err = resolveSubject(nc, topicName, "publish to", validSubject)
+	if nc != nil {
+		t.publish = nc.Publish
+	}
+	if opts.MaxConcurrentSends > 0 {
+		t.sem = make(chan struct{}, opts.MaxConcurrentSends)
+	}
+	return t
+}
+
+// CreateDynamicTopic returns a *pubsub.Topic that sends each message to the
+// subject in its "nats.subject" metadata, for publishers that fan out to many
+// subjects over nc. The key is removed from the metadata that is sent. Sending
+// a message that has no such key, or whose subject is not a valid subject to
+// publish to, fails with an error whose code is InvalidArgument. opts may be
+// nil.
+func CreateDynamicTopic(nc *nats.Conn, opts *TopicOptions) *pubsub.Topic {
+	t := newTopic(nc, "", opts)
+	t.dynamic, t.err = true, nil
+	return pubsub.NewTopic(t, nil)
+}
+
+// dynamicSubject returns the subject in md and the rest of md, for a message
+// sent with a dynamic topic.
+func dynamicSubject(md map[string]string) (string, map[string]string, error) {
+	subj, ok := md[subjectKey]
+	if !ok || !validSubject(subj) {
+		return "", nil, errInvalidSubject
+	}
+	return subj, withoutSubject(md), nil
+}
+
+// withoutSubject returns md, which has a "nats.subject" key, without it.
+func withoutSubject(md map[string]string) map[string]string {
+	if len(md) == 1 {
+		return nil
+	}
+	rest := make(map[string]string, len(md)-1)
+	for k, v := range md {
+		if k != subjectKey {
+			rest[k] = v
+		}
+	}
+	return rest
+}
+
+// resolveSubject returns the subject template subj expanded with the Vars of
+// nc, and a *subjectError if a placeholder has no variable, or the subject is
+// not valid to op according to valid.
+func resolveSubject(nc *nats.Conn, subj, op string, valid func(string) bool) (string, error) {
+	expanded, err := ExpandSubject(nc, subj)
+	if err != nil {
+		return subj, &subjectError{subj: subj, op: op, err: err}
+	}
+	if !valid(expanded) {
+		return expanded, &subjectError{subj: expanded, op: op}
+	}
+	return expanded, nil
+}
+
+// validSubject reports whether subj is a valid subject to publish to: it is
+// made of non-empty tokens separated by dots, with no wildcards, whitespace
+// or the braces of the placeholders of subject templates.
+func validSubject(subj string) bool {
+	if subj == "" || strings.ContainsAny(subj, " \t\r\n{}") {
+		return false
+	}
+	for _, tok := range strings.Split(subj, ".") {
+		if tok == "" || tok == "*" || tok == ">" {
+			return false
+		}
+	}
+	return true
+}
+
+// validSubscriptionSubject reports whether subj is a valid subject to
+// subscribe to: it is like a subject to publish to, but its tokens may be the
+// wildcard "*", which matches any token, and its last token may be the
+// wildcard ">", which matches one or more tokens.
+func validSubscriptionSubject(subj string) bool {
+	if subj == "" || strings.ContainsAny(subj, " \t\r\n{}") {
+		return false
+	}
+	toks := strings.Split(subj, ".")
+	for i, tok := range toks {
+		if tok == "" || tok == ">" && i != len(toks)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// subjectError is the error of a topic or subscription created with an
+// invalid subject. Its code is FailedPrecondition.
+type subjectError struct {
+	subj string
+	// op is the operation the subject is invalid for, "publish to" or
+	// "subscribe to".
+	op string
+	// err, if not nil, is the error expanding the subject template.
+	err error
+}
+
+func (e *subjectError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("natspubsub: %q is not a valid subject to %s: %v", e.subj, e.op, e.err)
+	}
+	return fmt.Sprintf("natspubsub: %q is not a valid subject to %s", e.subj, e.op)
 }
 
 // SendBatch implements driver.Topic.SendBatch.
@@ -87,6 +1016,17 @@ func (t *topic) SendBatch(ctx context.Context, msgs []*driver.Message) error {
 	if t == nil || t.nc == nil {
 		return errNotInitialized
 	}
+	if t.err != nil {
+		return t.err
+	}
+	if t.sem != nil {
+		select {
+		case t.sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() { <-t.sem }()
+	}
 
 	// Reuse if possible.
 	var em encMsg
@@ -94,34 +1034,161 @@ func (t *topic) SendBatch(ctx context.Context, msgs []*driver.Message) error {
 	b := raw[:0]
 	enc := codec.NewEncoderBytes(&b, &mh)
 
-	for _, m := range msgs {
-		var payload []byte
+	// prepare returns the subject and payload of m. The payload is only
+	// valid until the next call.
+	prepare := func(m *driver.Message) (string, []byte, error) {
+		subj, md := t.subj, m.Metadata
+		if t.dynamic {
+			var err error
+			if subj, md, err = dynamicSubject(md); err != nil {
+				return "", nil, err
+			}
+		} else if _, ok := md[subjectKey]; ok {
+			// The subject a message was received on, set by
+			// SubjectPattern; it doesn't route messages to t.
+			md = withoutSubject(md)
+		}
+		subj = t.partitionSubject(subj, m)
+		for k := range md {
+			if strings.HasPrefix(k, reservedPrefix) {
+				return "", nil, errReservedMetadata
+			}
+		}
+		payload := m.Body
+		if len(md) > 0 {
+			em.Body, em.Metadata = m.Body, md
+			if t.encoding == EncodingMsgpack {
+				enc.ResetBytes(&b)
+				if err := enc.Encode(em); err != nil {
+					return "", nil, err
+				}
+			} else {
+				var err error
+				if b, err = encodeEnvelope(b, t.encoding, &em); err != nil {
+					return "", nil, err
+				}
+			}
+			payload = b
+		}
+		// The metadata is part of the payload, so it counts toward the
+		// maximum payload size of the server.
+		if int64(len(payload)) > t.nc.MaxPayload() {
+			return "", nil, nats.ErrMaxPayload
+		}
+		return subj, payload, nil
+	}
+
+	if t.validateUpfront {
+		var verr BatchValidationError
+		for i, m := range msgs {
+			subj, _, err := prepare(m)
+			if err == nil && !validSubject(subj) {
+				err = nats.ErrBadSubject
+			}
+			if err != nil {
+				verr.Items = append(verr.Items, BatchValidationItem{Index: i, Err: err})
+			}
+		}
+		if len(verr.Items) > 0 {
+			return &verr
+		}
+	}
 
+	for i, m := range msgs {
 		if err := ctx.Err(); err != nil {
 			return err
 		}
-		if len(m.Metadata) == 0 {
-			payload = m.Body
-		} else {
-			enc.ResetBytes(&b)
-			em.Body, em.Metadata = m.Body, m.Metadata
-			if err := enc.Encode(em); err != nil {
-				return err
+		subj, payload, err := prepare(m)
+		if err != nil {
+			return &MessageError{Index: i, Err: err}
+		}
+		// A violation of an earlier publish is only reported now, as the
+		// server reports it asynchronously.
+		if err := takePermissionError(t.nc, "publish", subj); err != nil {
+			return &MessageError{Index: i, Err: err}
+		}
+		if err := t.publishWithRetries(ctx, subj, payload); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
 			}
-			payload = b
+			return &MessageError{Index: i, Err: err}
 		}
-		if err := t.nc.Publish(t.subj, payload); err != nil {
+	}
+	// Per specification this is supposed to only return after the messages
+	// have been sent. Flush once for the whole batch rather than per
+	// message, which would cost a round trip to the server each. While the
+	// connection is reconnecting, NATS buffers the messages and sends them
+	// once it is back, so there is nothing to wait for.
+	if len(msgs) == 0 || !t.nc.IsConnected() {
+		return nil
+	}
+	return flush(ctx, t.nc)
+}
+
+// defaultFlushTimeout is how long SendBatch waits for the server to process a
+// batch when its context has no deadline.
+const defaultFlushTimeout = 10 * time.Second
+
+// flush flushes nc, waiting until ctx is done, or for defaultFlushTimeout if
+// ctx has no deadline.
+func flush(ctx context.Context, nc *nats.Conn) error {
+	if _, ok := ctx.Deadline(); ok {
+		return nc.FlushWithContext(ctx)
+	}
+	return nc.FlushTimeout(defaultFlushTimeout)
+}
+
+// MessageError is the error of the message of a batch that could not be sent.
+// The messages before it in the batch were published, and the ones after it
+// were not. Get it from the error of Send with ErrorAs. Its code is the code
+// of Err.
+type MessageError struct {
+	// Index is the index of the message in the batch.
+	Index int
+	// Err is the reason the message could not be sent.
+	Err error
+}
+
+func (e *MessageError) Error() string {
+	return fmt.Sprintf("natspubsub: message %d of batch: %v", e.Index, e.Err)
+}
+
+// Backoffs between the retries of a publish.
+const (
+	minPublishBackoff = 10 * time.Millisecond
+	maxPublishBackoff = 500 * time.Millisecond
+)
+
+// publishWithRetries publishes data to subj, retrying up to t.retries times
+// while the publish fails with a transient error and ctx is not done.
+func (t *topic) publishWithRetries(ctx context.Context, subj string, data []byte) error {
+	backoff := minPublishBackoff
+	for attempt := 0; ; attempt++ {
+		err := t.publish(subj, data)
+		if err == nil || attempt >= t.retries || !isTransientPublishError(err) {
 			return err
 		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > maxPublishBackoff {
+			backoff = maxPublishBackoff
+		}
 	}
-	// Per specification this is supposed to only return after
-	// a message has been sent. Normally NATS is very efficient
-	// at sending messages in batches on its own and also handles
-	// disconnected buffering during a reconnect event. We will
-	// let NATS handle this for now. If needed we could add a
-	// FlushWithContext() call which ensures the connected server
-	// has processed all the messages.
-	return nil
+}
+
+// isTransientPublishError reports whether a publish failing with err may
+// succeed if retried, for example once the connection has reconnected.
+func isTransientPublishError(err error) bool {
+	switch err {
+	case nats.ErrReconnectBufExceeded, nats.ErrConnectionReconnecting, nats.ErrStaleConnection, nats.ErrTimeout:
+		return true
+	}
+	return false
 }
 
 // IsRetryable implements driver.Topic.IsRetryable.
@@ -138,19 +1205,49 @@ func (t *topic) As(i interface{}) bool {
 }
 
 // ErrorAs implements driver.Topic.ErrorAs
-func (*topic) ErrorAs(error, interface{}) bool {
+func (*topic) ErrorAs(err error, i interface{}) bool {
+	switch e := err.(type) {
+	case *BatchValidationError:
+		p, ok := i.(**BatchValidationError)
+		if !ok {
+			return false
+		}
+		*p = e
+		return true
+	case *MessageError:
+		p, ok := i.(**MessageError)
+		if !ok {
+			return false
+		}
+		*p = e
+		return true
+	}
 	return false
 }
 
 // ErrorCode implements driver.Topic.ErrorCode
-func (*topic) ErrorCode(err error) gcerrors.ErrorCode {
+func (t *topic) ErrorCode(err error) gcerrors.ErrorCode {
+	switch e := err.(type) {
+	case *permissionError:
+		return gcerrors.PermissionDenied
+	case *BatchValidationError:
+		return gcerrors.InvalidArgument
+	case *subjectError:
+		return gcerrors.FailedPrecondition
+	case *MessageError:
+		return t.ErrorCode(e.Err)
+	}
 	switch err {
 	case nil:
 		return gcerrors.OK
 	case context.Canceled:
 		return gcerrors.Canceled
+	case context.DeadlineExceeded, nats.ErrTimeout:
+		return gcerrors.DeadlineExceeded
 	case errNotInitialized, nats.ErrBadSubject:
 		return gcerrors.FailedPrecondition
+	case errReservedMetadata, errInvalidSubject:
+		return gcerrors.InvalidArgument
 	case nats.ErrAuthorization:
 		return gcerrors.PermissionDenied
 	case nats.ErrMaxPayload, nats.ErrReconnectBufExceeded:
@@ -163,17 +1260,298 @@ type subscription struct {
 	nc   *nats.Conn
 	nsub *nats.Subscription
 	err  error
+	mode DecodeMode
+	// decodeErr is the error decoding a message, to be returned by the next
+	// call to ReceiveBatch.
+	decodeErr error
+	// filter is SubscriptionOptions.Filter.
+	filter func(*driver.Message) bool
+	// pattern holds the tokens of SubscriptionOptions.SubjectPattern, or is
+	// nil if it is not set.
+	pattern []string
+}
+
+// SubscriptionOptions sets options for constructing a *pubsub.Subscription
+// backed by NATS.
+type SubscriptionOptions struct {
+	// OnReconnect, if set, is called when the connection reconnects to a
+	// server. NATS does not resend the messages published while the connection
+	// was down, so consumers that care about gaps can use it to resynchronize.
+	// It is only supported on connections created by Dial; receiving from a
+	// subscription with OnReconnect on another connection fails with an
+	// error whose code is FailedPrecondition. It is called until the
+	// *nats.Subscription, obtained with As, is unsubscribed, such as by
+	// SubscriptionGroup.CloseAll: Shutdown alone doesn't unsubscribe it.
+	OnReconnect func()
+
+	// DecodeMode controls how the data of received NATS messages is decoded.
+	// Defaults to DecodeAuto.
+	DecodeMode DecodeMode
+
+	// Queue, if set, makes the subscription a member of the named queue
+	// group: each message is delivered to a single member of the group.
+	// The share of the traffic of this member, for example to make scaling
+	// decisions, is available with Delivered (messages received) and Pending
+	// (messages waiting to be received) on the *nats.Subscription obtained
+	// with As.
+	Queue string
+
+	// Filter, if set, is called with each received message after it is
+	// decoded; messages for which it returns false are skipped: they are not
+	// returned by Receive, nor counted in the size of batches. NATS does not
+	// redeliver messages, so skipped messages are dropped.
+	Filter func(*driver.Message) bool
+
+	// SubjectPattern, if set, extracts the tokens of the subjects of
+	// received messages into their metadata. It is a subject whose tokens
+	// are either literal or a name in braces, as in "orders.{region}.{id}":
+	// a message received on "orders.us.42" gets the metadata region=us and
+	// id=42. Every message also gets its subject in its "nats.subject"
+	// metadata; messages whose subject doesn't match the pattern get only
+	// that. Metadata sent with a message takes precedence over extracted
+	// tokens. Filter sees the extracted metadata. Sending such a message
+	// again with a topic that is not dynamic drops the "nats.subject" key;
+	// a dynamic topic sends it back to the subject it was received on,
+	// unless the key is changed first.
+	SubjectPattern string
 }
 
+// DecodeMode controls how a subscription decodes the data of the NATS
+// messages it receives into a *pubsub.Message.
+//
+// A natspubsub topic sends a message that has metadata as a msgpack envelope
+// holding its body and metadata, and a message without metadata as its body
+// alone. Envelopes in other encodings carry a descriptor of their format;
+// unless the mode is DecodeRaw, receiving an envelope in a format that the
+// subscription does not support, such as one written by a newer version of
+// this package, fails with an error whose code is FailedPrecondition, and the
+// message is dropped.
+type DecodeMode int
+
+const (
+	// DecodeAuto decodes the envelope of messages that have one, and uses the
+	// data of other messages as the body.
+	DecodeAuto DecodeMode = iota
+	// DecodeStrict requires every message to have an envelope. Receiving a
+	// message without one fails with an error whose code is InvalidArgument,
+	// and the message is dropped.
+	DecodeStrict
+	// DecodeRaw never decodes messages: the data of every message, including
+	// its envelope if it has one, is used as the body.
+	DecodeRaw
+)
+
 // CreateSubscription returns a *pubsub.Subscription representing a NATS subscription.
-// TODO(dlc) - Options for queue groups?
-func CreateSubscription(nc *nats.Conn, subscriptionName string) *pubsub.Subscription {
-	return pubsub.NewSubscription(createSubscription(nc, subscriptionName), nil)
+// subscriptionName is the subject to subscribe to; it may contain the wildcards
+// "*", matching any token, as in "orders.*", and ">" as its last token,
+// matching one or more tokens, as in "orders.>". Receiving from a
+// subscription whose subject is malformed fails with an error whose code is
+// FailedPrecondition.
+// opts may be nil.
+func CreateSubscription(nc *nats.Conn, subscriptionName string, opts *SubscriptionOptions) *pubsub.Subscription {
+	return pubsub.NewSubscription(createSubscription(nc, subscriptionName, opts), nil)
 }
 
-func createSubscription(nc *nats.Conn, subscriptionName string) driver.Subscription {
-	sub, err := nc.SubscribeSync(subscriptionName)
-	return &subscription{nc, sub, err}
+var errReconnectNotDialed = errors.New("natspubsub: OnReconnect requires a connection created by Dial")
+
+func createSubscription(nc *nats.Conn, subscriptionName string, opts *SubscriptionOptions) driver.Subscription {
+	if opts == nil {
+		opts = &SubscriptionOptions{}
+	}
+	var (
+		sub   *nats.Subscription
+		state *connState
+	)
+	if v, ok := conns.Load(nc); ok {
+		state = v.(*connState)
+	}
+	subj, err := resolveSubject(nc, subscriptionName, "subscribe to", validSubscriptionSubject)
+	switch {
+	case err != nil:
+		// The subject is invalid; ReceiveBatch returns err.
+	case opts.OnReconnect != nil && state == nil:
+		err = errReconnectNotDialed
+	case opts.Queue != "":
+		sub, err = nc.QueueSubscribeSync(subj, opts.Queue)
+	default:
+		sub, err = nc.SubscribeSync(subj)
+	}
+	if sub != nil && opts.OnReconnect != nil {
+		state.reconnect.add(sub, opts.OnReconnect)
+	}
+	ds := &subscription{nc: nc, nsub: sub, err: err, mode: opts.DecodeMode, filter: opts.Filter}
+	if opts.SubjectPattern != "" {
+		ds.pattern = strings.Split(opts.SubjectPattern, ".")
+	}
+	return ds
+}
+
+// ReceiveTimeout is like sub.Receive, but waits at most d for a message, for
+// polling loops. If no message arrives in time, it returns a nil message and
+// a nil error; it returns an error only if receiving fails or ctx is done.
+func ReceiveTimeout(ctx context.Context, sub *pubsub.Subscription, d time.Duration) (*pubsub.Message, error) {
+	ctx2, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	m, err := sub.Receive(ctx2)
+	if err != nil && ctx.Err() == nil && ctx2.Err() == context.DeadlineExceeded {
+		return nil, nil
+	}
+	return m, err
+}
+
+// HandlerOptions sets options for Subscribe.
+type HandlerOptions struct {
+	// MaxHandlers is the maximum number of handlers that run at the same
+	// time. The default is 1, which handles messages one at a time, in the
+	// order they are received.
+	MaxHandlers int
+
+	// OnError is called with a message and the error its handler returned.
+	// Core NATS has no negative acknowledgements, so the message is not
+	// redelivered. By default, the error is logged to Logger.
+	OnError func(*pubsub.Message, error)
+
+	// Logger, if set, receives the errors returned by handlers when OnError
+	// is nil. If both are nil, the errors are dropped.
+	Logger Logger
+}
+
+// Backoffs between the receives of Subscribe while the connection is down.
+const (
+	minReceiveBackoff = 100 * time.Millisecond
+	maxReceiveBackoff = 5 * time.Second
+)
+
+// Subscribe receives messages from sub and calls handler with each of them
+// until ctx is done or receiving fails, so simple consumers don't need a
+// receive loop. A message is acked if its handler returns nil; otherwise it
+// is passed to opts.OnError, or its error is logged to opts.Logger. opts may
+// be nil.
+//
+// While the connection is down, such as during a reconnect, receiving fails
+// with an error whose code is Unavailable; Subscribe keeps receiving, backing
+// off from 100ms to 5s, until the connection is back or ctx is done.
+//
+// Subscribe waits for running handlers before it returns. It returns
+// ctx.Err() if ctx is done, and the error of sub.Receive otherwise.
+func Subscribe(ctx context.Context, sub *pubsub.Subscription, handler func(*pubsub.Message) error, opts *HandlerOptions) error {
+	if opts == nil {
+		opts = &HandlerOptions{}
+	}
+	n := opts.MaxHandlers
+	if n <= 0 {
+		n = 1
+	}
+	onError := opts.OnError
+	if onError == nil {
+		l := opts.Logger
+		onError = func(_ *pubsub.Message, err error) {
+			if l != nil {
+				l.Printf("natspubsub: message handler failed: %v", err)
+			}
+		}
+	}
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	backoff := minReceiveBackoff
+	for {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		m, err := sub.Receive(ctx)
+		if err != nil {
+			<-sem
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if gcerrors.Code(err) != gcerrors.Unavailable {
+				return err
+			}
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+			if backoff *= 2; backoff > maxReceiveBackoff {
+				backoff = maxReceiveBackoff
+			}
+			continue
+		}
+		backoff = minReceiveBackoff
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := handler(m); err != nil {
+				onError(m, err)
+				return
+			}
+			m.Ack()
+		}()
+	}
+}
+
+// SubscriptionGroup tracks subscriptions so that they can be closed
+// together, for example on shutdown of a service that opens subscriptions
+// dynamically. The zero value is an empty group. It is safe for concurrent
+// use.
+type SubscriptionGroup struct {
+	mu   sync.Mutex
+	subs []*pubsub.Subscription
+}
+
+// CreateSubscription is like the package-level CreateSubscription, and adds
+// the subscription to g.
+func (g *SubscriptionGroup) CreateSubscription(nc *nats.Conn, subscriptionName string, opts *SubscriptionOptions) *pubsub.Subscription {
+	sub := CreateSubscription(nc, subscriptionName, opts)
+	g.Add(sub)
+	return sub
+}
+
+// Add adds sub, a subscription created by this package, to g.
+func (g *SubscriptionGroup) Add(sub *pubsub.Subscription) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.subs = append(g.subs, sub)
+}
+
+// CloseAll shuts down every subscription of g and unsubscribes its
+// *nats.Subscription, dropping the messages not received yet, and empties g.
+// It closes all the subscriptions even if some fail, and returns an error
+// listing the failures.
+func (g *SubscriptionGroup) CloseAll(ctx context.Context) error {
+	g.mu.Lock()
+	subs := g.subs
+	g.subs = nil
+	g.mu.Unlock()
+
+	var msgs []string
+	for _, sub := range subs {
+		err := sub.Shutdown(ctx)
+		var nsub *nats.Subscription
+		if sub.As(&nsub) && nsub != nil {
+			if nsub.IsValid() {
+				if uerr := nsub.Unsubscribe(); uerr != nil && err == nil {
+					err = uerr
+				}
+			}
+			forgetOnReconnect(nsub)
+		}
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("natspubsub: closing %d of %d subscriptions failed: %s", len(msgs), len(subs), strings.Join(msgs, "; "))
+	}
+	return nil
 }
 
 // AckFunc implements driver.Subscription.AckFunc.
@@ -181,7 +1559,13 @@ func (*subscription) AckFunc() func() { return nil }
 
 // ReceiveBatch implements driver.ReceiveBatch.
 func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*driver.Message, error) {
-	if s == nil || s.nsub == nil {
+	if s == nil {
+		return nil, nats.ErrBadSubscription
+	}
+	if _, ok := s.err.(*subjectError); ok || s.err == errReconnectNotDialed {
+		return nil, s.err
+	}
+	if s.nsub == nil {
 		return nil, nats.ErrBadSubscription
 	}
 
@@ -190,6 +1574,15 @@ func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*dr
 		return nil, err
 	}
 
+	// Report a message that could not be decoded by the previous call.
+	if err := s.decodeErr; err != nil {
+		s.decodeErr = nil
+		return nil, err
+	}
+	if err := takePermissionError(s.nc, "subscription", s.nsub.Subject); err != nil {
+		return nil, err
+	}
+
 	var ms []*driver.Message
 
 	// We will assume the desired goal is at least one message since the public API only has Receive().
@@ -197,9 +1590,18 @@ func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*dr
 	for {
 		msg, err := s.nsub.NextMsg(0)
 		if err == nil {
-			dm, err := decode(msg)
+			dm, err := s.decode(msg)
 			if err != nil {
-				return nil, err
+				if len(ms) == 0 {
+					return nil, err
+				}
+				// Return the messages decoded so far, and the error on the
+				// next call.
+				s.decodeErr = err
+				break
+			}
+			if !s.accept(dm) {
+				continue
 			}
 			ms = append(ms, dm)
 			if len(ms) >= maxMessages {
@@ -208,6 +1610,12 @@ func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*dr
 		} else if err == nats.ErrTimeout {
 			break
 		} else {
+			err = closedError(err)
+			if err == ErrSubscriptionClosed && len(ms) > 0 {
+				// Return the messages delivered before the end, and the
+				// error on the next call.
+				break
+			}
 			return nil, err
 		}
 	}
@@ -221,30 +1629,128 @@ func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*dr
 	// get a burst of messages but we will only wait once here and let the next call grab them.
 	// The reason is so that if deadline is not properly set we will not needlessly wait here
 	// for more messages when the user most likely only wants one.
-	msg, err := s.nsub.NextMsgWithContext(ctx)
-	if err != nil {
-		return nil, err
+	// If ctx has no deadline we block until a message arrives; nats.ErrTimeout is
+	// only returned to the caller when ctx itself is done.
+	// We wait in slices of connCheckInterval so that losing the connection
+	// while no message arrives is reported rather than waited out.
+	for {
+		wctx, cancel := context.WithTimeout(ctx, connCheckInterval)
+		msg, err := s.nsub.NextMsgWithContext(wctx)
+		cancel()
+		if err == nil {
+			dm, err := s.decode(msg)
+			if err != nil {
+				return nil, err
+			}
+			if !s.accept(dm) {
+				continue
+			}
+			return append(ms, dm), nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if err != nats.ErrTimeout && err != context.DeadlineExceeded {
+			return nil, closedError(err)
+		}
+		if err := connError(s.nc); err != nil {
+			return nil, err
+		}
 	}
-	dm, err := decode(msg)
-	if err != nil {
-		return nil, err
+}
+
+// decode decodes msg, adding the metadata extracted from its subject if s has
+// a subject pattern.
+func (s *subscription) decode(msg *nats.Msg) (*driver.Message, error) {
+	dm, err := decode(msg, s.mode)
+	if err != nil || s.pattern == nil {
+		return dm, err
 	}
-	ms = append(ms, dm)
-	return ms, nil
+	md := map[string]string{subjectKey: msg.Subject}
+	if tokens := strings.Split(msg.Subject, "."); len(tokens) == len(s.pattern) {
+		vars := map[string]string{}
+		for i, p := range s.pattern {
+			if len(p) > 2 && p[0] == '{' && p[len(p)-1] == '}' {
+				vars[p[1:len(p)-1]] = tokens[i]
+			} else if p != tokens[i] {
+				vars = nil
+				break
+			}
+		}
+		for k, v := range vars {
+			md[k] = v
+		}
+	}
+	for k, v := range dm.Metadata {
+		md[k] = v
+	}
+	dm.Metadata = md
+	return dm, nil
+}
+
+// accept reports whether dm passes the filter of s, if any.
+func (s *subscription) accept(dm *driver.Message) bool {
+	return s.filter == nil || s.filter(dm)
+}
+
+// connCheckInterval is how often a blocked ReceiveBatch checks that its
+// connection is still up.
+const connCheckInterval = 250 * time.Millisecond
+
+var errDisconnected = errors.New("natspubsub: disconnected from the server")
+
+// ErrSubscriptionClosed is returned by Receive once the subscription has
+// ended, because it was drained or unsubscribed, or reached its
+// auto-unsubscribe limit, through the *nats.Subscription exposed by As. No
+// more messages will be received; loops can check for it with errors.Is and
+// stop. Its code is NotFound.
+var ErrSubscriptionClosed = errors.New("natspubsub: subscription closed")
+
+// closedError returns ErrSubscriptionClosed if err is an error of NextMsg on
+// a subscription that has ended, and err otherwise.
+func closedError(err error) error {
+	if err == nats.ErrBadSubscription || err == nats.ErrMaxMessages {
+		return ErrSubscriptionClosed
+	}
+	return err
+}
+
+// connError returns the error to report for a receive on nc that is blocked
+// because nc is not connected, or nil if nc is connected. A connection that
+// is reconnecting may recover, so its error is Unavailable; a closed one is
+// not.
+func connError(nc *nats.Conn) error {
+	switch nc.Status() {
+	case nats.CLOSED:
+		return nats.ErrConnectionClosed
+	case nats.DISCONNECTED, nats.RECONNECTING, nats.CONNECTING:
+		return errDisconnected
+	}
+	return nil
 }
 
 // Convert NATS msgs to *driver.Message.
-func decode(msg *nats.Msg) (*driver.Message, error) {
+func decode(msg *nats.Msg, mode DecodeMode) (*driver.Message, error) {
 	if msg == nil {
 		return nil, nats.ErrInvalidMsg
 	}
 	var dm driver.Message
-	// Everything is in the msg.Data
-	dec := codec.NewDecoderBytes(msg.Data, &mh)
-	err := dec.Decode(&dm)
-	if err != nil {
-		// This may indicate a normal NATS message, so just treat as the body.
+	if mode == DecodeRaw {
 		dm.Body = msg.Data
+	} else {
+		// Everything is in the msg.Data
+		if err := decodeEnvelope(msg.Data, &dm); err != nil {
+			if _, ok := err.(*unsupportedFormatError); ok {
+				// An envelope, but not one we can decode: returning its
+				// data as the body would hand garbage to the application.
+				return nil, err
+			}
+			if mode == DecodeStrict {
+				return nil, errNotEncoded
+			}
+			// This may indicate a normal NATS message, so just treat as the body.
+			dm.Body = msg.Data
+		}
 	}
 	dm.AckID = -1 // Not applicable to NATS
 	dm.AsFunc = messageAsFunc(msg)
@@ -288,13 +1794,30 @@ func (*subscription) ErrorAs(error, interface{}) bool {
 
 // ErrorCode implements driver.Subscription.ErrorCode
 func (*subscription) ErrorCode(err error) gcerrors.ErrorCode {
+	if _, ok := err.(*permissionError); ok {
+		return gcerrors.PermissionDenied
+	}
+	if _, ok := err.(*unsupportedFormatError); ok {
+		return gcerrors.FailedPrecondition
+	}
+	if _, ok := err.(*subjectError); ok {
+		return gcerrors.FailedPrecondition
+	}
 	switch err {
 	case nil:
 		return gcerrors.OK
 	case context.Canceled:
 		return gcerrors.Canceled
-	case errNotInitialized, nats.ErrBadSubject, nats.ErrBadSubscription, nats.ErrTypeSubscription:
+	case context.DeadlineExceeded:
+		return gcerrors.DeadlineExceeded
+	case errNotEncoded:
+		return gcerrors.InvalidArgument
+	case ErrSubscriptionClosed:
+		return gcerrors.NotFound
+	case errNotInitialized, nats.ErrBadSubject, nats.ErrBadSubscription, nats.ErrTypeSubscription, nats.ErrConnectionClosed, errReconnectNotDialed:
 		return gcerrors.FailedPrecondition
+	case errDisconnected, nats.ErrNoServers:
+		return gcerrors.Unavailable
 	case nats.ErrAuthorization:
 		return gcerrors.PermissionDenied
 	case nats.ErrMaxMessages, nats.ErrSlowConsumer:
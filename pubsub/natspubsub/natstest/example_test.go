@@ -0,0 +1,54 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package natstest_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/natspubsub"
+	"gocloud.dev/pubsub/natspubsub/natstest"
+)
+
+func ExampleRunServer() {
+	ctx := context.Background()
+
+	// Start an embedded NATS server on a random port.
+	nc, cleanup, err := natstest.RunServer(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cleanup()
+
+	sub := natspubsub.CreateSubscription(nc, "example.subject", nil)
+	defer sub.Shutdown(ctx)
+	topic := natspubsub.CreateTopic(nc, "example.subject", nil)
+	defer topic.Shutdown(ctx)
+
+	if err := topic.Send(ctx, &pubsub.Message{Body: []byte("hello")}); err != nil {
+		log.Fatal(err)
+	}
+	msg, err := sub.Receive(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	msg.Ack()
+	fmt.Println(string(msg.Body))
+
+	// Output:
+	// hello
+}
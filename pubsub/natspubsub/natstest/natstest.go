@@ -0,0 +1,83 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package natstest provides an embedded NATS server for tests of code that
+// uses natspubsub.
+package natstest // import "gocloud.dev/pubsub/natspubsub/natstest"
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/go-nats"
+)
+
+// Options controls the server started by RunServer.
+type Options struct {
+	// Port is the port the server listens on, on 127.0.0.1. Defaults to a
+	// random free port.
+	Port int
+
+	// Username and Password, if set, are required from clients, and are used
+	// by the returned connection.
+	Username string
+	Password string
+}
+
+// RunServer starts an embedded NATS server and returns a connection to it,
+// along with a function that closes the connection and shuts the server down.
+// opts may be nil to use the defaults.
+func RunServer(opts *Options) (*nats.Conn, func(), error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	sopts := &server.Options{
+		Host:     "127.0.0.1",
+		Port:     opts.Port,
+		Username: opts.Username,
+		Password: opts.Password,
+		NoLog:    true,
+		NoSigs:   true,
+	}
+	if sopts.Port == 0 {
+		sopts.Port = server.RANDOM_PORT
+	}
+	s := server.New(sopts)
+	if s == nil {
+		return nil, nil, errors.New("natstest: invalid server options")
+	}
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		s.Shutdown()
+		return nil, nil, errors.New("natstest: server did not start")
+	}
+	addr := s.Addr().(*net.TCPAddr)
+	var connOpts []nats.Option
+	if opts.Username != "" {
+		connOpts = append(connOpts, nats.UserInfo(opts.Username, opts.Password))
+	}
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", addr.IP, addr.Port), connOpts...)
+	if err != nil {
+		s.Shutdown()
+		return nil, nil, err
+	}
+	cleanup := func() {
+		nc.Close()
+		s.Shutdown()
+	}
+	return nc, cleanup, nil
+}
@@ -165,6 +165,11 @@ func (k *keeper) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error)
 	return result.CiphertextBlob, nil
 }
 
+// As implements driver.Keeper.As.
+func (k *keeper) As(i interface{}) bool {
+	return false
+}
+
 // ErrorAs implements driver.Keeper.ErrorAs.
 func (k *keeper) ErrorAs(err error, i interface{}) bool {
 	e, ok := err.(awserr.Error)
@@ -222,6 +222,11 @@ func (k *keeper) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error)
 	return base64.StdEncoding.DecodeString(*keyOpsResult.Result)
 }
 
+// As implements driver.Keeper.As.
+func (k *keeper) As(i interface{}) bool {
+	return false
+}
+
 // ErrorAs implements driver.Keeper.ErrorAs.
 func (k *keeper) ErrorAs(err error, i interface{}) bool {
 	e, ok := err.(autorest.DetailedError)
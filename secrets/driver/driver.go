@@ -36,6 +36,10 @@ type Keeper interface {
 	// Encrypt encrypts the plaintext using the key, and returns the ciphertext.
 	Encrypt(ctx context.Context, plaintext []byte) ([]byte, error)
 
+	// As allows providers to expose provider-specific types.
+	// See https://godoc.org/gocloud.dev#As for background information.
+	As(i interface{}) bool
+
 	// ErrorAs allows providers to expose provider-specific types for returned
 	// errors.
 	//
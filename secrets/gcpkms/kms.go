@@ -164,6 +164,11 @@ func (k *keeper) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error)
 	return resp.GetCiphertext(), nil
 }
 
+// As implements driver.Keeper.As.
+func (k *keeper) As(i interface{}) bool {
+	return false
+}
+
 // ErrorAs implements driver.Keeper.ErrorAs.
 func (k *keeper) ErrorAs(err error, i interface{}) bool {
 	s, ok := status.FromError(err)
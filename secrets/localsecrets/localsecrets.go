@@ -146,6 +146,11 @@ func (k *keeper) Decrypt(ctx context.Context, message []byte) ([]byte, error) {
 	return decrypted, nil
 }
 
+// As implements driver.Keeper.As.
+func (k *keeper) As(i interface{}) bool {
+	return false
+}
+
 // ErrorAs implements driver.Keeper.ErrorAs.
 func (k *keeper) ErrorAs(err error, i interface{}) bool {
 	return false
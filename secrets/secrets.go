@@ -125,6 +125,14 @@ func (k *Keeper) Decrypt(ctx context.Context, ciphertext []byte) (plaintext []by
 	return b, nil
 }
 
+// As converts i to provider-specific types.
+// See https://godoc.org/gocloud.dev#As for background information and the
+// provider-specific package documentation for the specific types supported for
+// that provider.
+func (k *Keeper) As(i interface{}) bool {
+	return k.k.As(i)
+}
+
 // ErrorAs converts i to provider-specific types. See
 // https://godoc.org/gocloud.dev#As for background information and the
 // provider-specific package documentation for the specific types supported for
@@ -0,0 +1,166 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"sync"
+
+	"github.com/hashicorp/vault/api"
+	"gocloud.dev/internal/gcerr"
+)
+
+// authenticator is implemented by the auth methods supported in Config.
+type authenticator interface {
+	// login logs in to Vault with client and returns the resulting token.
+	login(ctx context.Context, client *api.Client) (string, error)
+	// name returns the name of the auth method, for logging.
+	name() string
+}
+
+// authMethod returns the auth method configured in cfg, or nil if there is
+// none.
+func (cfg *Config) authMethod() authenticator {
+	switch {
+	case cfg.Userpass != nil:
+		return cfg.Userpass
+	case cfg.AppRole != nil:
+		return cfg.AppRole
+	}
+	return nil
+}
+
+// UserpassAuth configures Dial to log in to Vault with the userpass auth
+// method, rather than using a fixed token.
+// See https://www.vaultproject.io/docs/auth/userpass.html for more
+// information.
+type UserpassAuth struct {
+	Username string
+	Password string
+	// MountPath is the path the auth method is enabled at. Defaults to
+	// "userpass".
+	MountPath string
+}
+
+func (a *UserpassAuth) name() string { return "userpass" }
+
+func (a *UserpassAuth) login(ctx context.Context, client *api.Client) (string, error) {
+	mount := a.MountPath
+	if mount == "" {
+		mount = "userpass"
+	}
+	return login(ctx, client, path.Join("auth", mount, "login", a.Username), map[string]interface{}{
+		"password": a.Password,
+	})
+}
+
+// AppRoleAuth configures Dial to log in to Vault with the AppRole auth method,
+// rather than using a fixed token.
+// See https://www.vaultproject.io/docs/auth/approle.html for more
+// information.
+type AppRoleAuth struct {
+	RoleID   string
+	SecretID string
+	// WrappedSecretIDToken, if set, is a response-wrapping token wrapping the
+	// SecretID, as delivered by secure AppRole bootstrapping flows. It is used
+	// instead of SecretID: the SecretID is unwrapped on the first login and
+	// kept for the later ones. A wrapping token that was already used or has
+	// expired makes the login fail with an error whose code is
+	// PermissionDenied.
+	WrappedSecretIDToken string
+	// MountPath is the path the auth method is enabled at. Defaults to
+	// "approle".
+	MountPath string
+
+	mu        sync.Mutex
+	unwrapped string // the SecretID unwrapped from WrappedSecretIDToken
+}
+
+func (a *AppRoleAuth) name() string { return "AppRole" }
+
+func (a *AppRoleAuth) login(ctx context.Context, client *api.Client) (string, error) {
+	mount := a.MountPath
+	if mount == "" {
+		mount = "approle"
+	}
+	secretID, err := a.secretID(ctx, client)
+	if err != nil {
+		return "", err
+	}
+	data := map[string]interface{}{
+		"role_id": a.RoleID,
+	}
+	if secretID != "" {
+		data["secret_id"] = secretID
+	}
+	return login(ctx, client, path.Join("auth", mount, "login"), data)
+}
+
+// secretID returns the SecretID to log in with, unwrapping it from
+// WrappedSecretIDToken the first time if it is set.
+func (a *AppRoleAuth) secretID(ctx context.Context, client *api.Client) (string, error) {
+	if a.WrappedSecretIDToken == "" {
+		return a.SecretID, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.unwrapped != "" {
+		return a.unwrapped, nil
+	}
+	// The wrapping token authenticates the unwrap request itself.
+	ctx = context.WithValue(ctx, loginKey{}, true)
+	ctx = context.WithValue(ctx, tokenKey{}, a.WrappedSecretIDToken)
+	secret, err := write(ctx, client, "sys/wrapping/unwrap", nil)
+	if err != nil {
+		if e, ok := err.(*ResponseError); ok && (e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusForbidden) {
+			return "", gcerr.New(gcerr.PermissionDenied, err, 1, "vault: unwrapping the AppRole SecretID failed")
+		}
+		return "", wrapError(err)
+	}
+	var id string
+	if secret != nil {
+		id, _ = secret.Data["secret_id"].(string)
+	}
+	if id == "" {
+		return "", errors.New("vault: wrapping token does not wrap an AppRole SecretID")
+	}
+	a.unwrapped = id
+	return id, nil
+}
+
+// loginKey is the context key marking the requests made to log in, which must
+// not trigger a new login when they are rejected.
+type loginKey struct{}
+
+// login logs in by writing data to the login endpoint at p, and returns the
+// resulting client token. Vault rejecting the credentials is reported as
+// PermissionDenied.
+func login(ctx context.Context, client *api.Client, p string, data map[string]interface{}) (string, error) {
+	ctx = context.WithValue(ctx, loginKey{}, true)
+	secret, err := write(ctx, client, p, data)
+	if err != nil {
+		if e, ok := err.(*ResponseError); ok && (e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusForbidden) {
+			return "", gcerr.New(gcerr.PermissionDenied, err, 1, "vault: login failed")
+		}
+		return "", wrapError(err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return "", errors.New("vault: login response has no client token")
+	}
+	return secret.Auth.ClientToken, nil
+}
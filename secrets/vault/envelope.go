@@ -0,0 +1,178 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The format written by EncryptLarge is:
+//  - the length of the encrypted data key, as a big-endian uint32;
+//  - the data key encrypted with the transit key;
+//  - the payload split into chunks of at most chunkSize bytes, each sealed
+//    with AES-GCM under the data key and preceded by its sealed length as a
+//    big-endian uint32.
+// The nonce of a chunk is its index as a big-endian uint64, followed by a
+// byte set to 1 for the last chunk, so that chunks can be neither reordered
+// nor dropped, and the stream cannot be truncated.
+
+// chunkSize is the maximum size of the plaintext of a chunk.
+const chunkSize = 64 * 1024
+
+// maxEncryptedDataKeySize bounds the size of the encrypted data key read by
+// DecryptLarge.
+const maxEncryptedDataKeySize = 64 * 1024
+
+// EncryptLarge encrypts the payload read from r and writes the result to w,
+// using envelope encryption: the payload is encrypted locally with a new data
+// key, so its size is not limited by Vault, and only the data key is encrypted
+// with the transit key. The result can be decrypted with DecryptLarge.
+func (k *Key) EncryptLarge(ctx context.Context, r io.Reader, w io.Writer) error {
+	dataKey, encryptedKey, err := k.generateDataKey(ctx, 256)
+	if err != nil {
+		return err
+	}
+	aead, err := newChunkAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+	if err := writeBlock(w, encryptedKey); err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(r, chunkSize)
+	buf := make([]byte, chunkSize)
+	for i := uint64(0); ; i++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := err != nil
+		if !last {
+			// A full chunk is the last one if nothing follows it.
+			if _, err := br.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+		sealed := aead.Seal(nil, chunkNonce(i, last), buf[:n], nil)
+		if err := writeBlock(w, sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// DecryptLarge decrypts the result of EncryptLarge read from r and writes the
+// payload to w. It fails if the encrypted stream was modified or truncated;
+// since the payload is written as it is decrypted, w may have received part
+// of it when that happens.
+func (k *Key) DecryptLarge(ctx context.Context, r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	encryptedKey, err := readBlock(br, maxEncryptedDataKeySize)
+	if err != nil {
+		return err
+	}
+	dataKey, err := k.k.Decrypt(ctx, encryptedKey)
+	if err != nil {
+		return wrapError(err)
+	}
+	aead, err := newChunkAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); ; i++ {
+		sealed, err := readBlock(br, chunkSize+aead.Overhead())
+		if err == io.EOF {
+			return errors.New("vault: encrypted stream is truncated")
+		}
+		if err != nil {
+			return err
+		}
+		_, err = br.Peek(1)
+		last := err == io.EOF
+		if err != nil && !last {
+			return err
+		}
+		chunk, err := aead.Open(sealed[:0], chunkNonce(i, last), sealed, nil)
+		if err != nil {
+			return fmt.Errorf("vault: chunk %d of encrypted stream failed authentication", i)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func newChunkAEAD(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(i uint64, last bool) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce, i)
+	if last {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
+
+// writeBlock writes b to w, preceded by its length.
+func writeBlock(w io.Writer, b []byte) error {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(b)))
+	if _, err := w.Write(n[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readBlock reads a block written by writeBlock from r. It returns io.EOF if r
+// has no more data, and an error if the block is longer than max.
+func readBlock(r io.Reader, max int) ([]byte, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("vault: encrypted stream is truncated")
+		}
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(n[:])
+	if int64(size) > int64(max) {
+		return nil, fmt.Errorf("vault: invalid block of %d bytes in encrypted stream", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errors.New("vault: encrypted stream is truncated")
+	}
+	return b, nil
+}
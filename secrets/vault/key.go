@@ -0,0 +1,684 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"go.opencensus.io/trace"
+	"gocloud.dev/internal/gcerr"
+	"gocloud.dev/secrets"
+)
+
+// Key provides operations of the Transit Secrets Engine on a single named key
+// that are not part of the portable *secrets.Keeper API.
+type Key struct {
+	k *keeper
+}
+
+// NewKey returns a *Key for the transit key keyID.
+func NewKey(client *api.Client, keyID string, opts *KeeperOptions) *Key {
+	return &Key{k: newKeeper(client, keyID, opts)}
+}
+
+// Keeper returns a *secrets.Keeper that encrypts and decrypts using the key.
+func (k *Key) Keeper() *secrets.Keeper {
+	return secrets.NewKeeper(k.k)
+}
+
+// DecryptWithKey decrypts ciphertext with the transit key keyName instead of
+// the key of k, using the same client and options. Use it for data that was
+// encrypted before the application switched to a different key. A key name
+// embedded in ciphertext with KeeperOptions.EmbedKeyName is ignored.
+func (k *Key) DecryptWithKey(ctx context.Context, keyName string, ciphertext []byte) (_ []byte, err error) {
+	ctx, span := trace.StartSpan(ctx, "vault.Decrypt")
+	span.AddAttributes(trace.StringAttribute("key_id", keyName))
+	defer func() { endSpan(span, err) }()
+
+	_, ciphertext = splitKeyName(ciphertext)
+	b, err := k.k.decrypt(ctx, keyName, ciphertext)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return b, nil
+}
+
+// DecryptWithInfo is like Decrypt on k.Keeper(), but also returns the version
+// of the key that protected ciphertext, for example to rewrap the ciphertexts
+// produced with old versions while reading them. Use BatchRewrap to rewrap
+// them.
+func (k *Key) DecryptWithInfo(ctx context.Context, ciphertext []byte) (plaintext []byte, keyVersion int, err error) {
+	v, err := KeyVersion(ciphertext)
+	if err != nil {
+		return nil, 0, gcerr.New(gcerr.InvalidArgument, err, 1, "vault: invalid ciphertext")
+	}
+	plaintext, err = k.k.Decrypt(ctx, ciphertext)
+	if err != nil {
+		return nil, 0, wrapError(err)
+	}
+	return plaintext, v, nil
+}
+
+// GenerateDataKey asks Vault to generate a new data key for use in envelope
+// encryption. It returns the data key in plaintext, for encrypting data
+// locally, and the data key encrypted with the transit key. Only the
+// ciphertext should be stored; it can be decrypted back into the data key with
+// Decrypt on k.Keeper().
+func (k *Key) GenerateDataKey(ctx context.Context) (plaintext, ciphertext []byte, err error) {
+	return k.generateDataKey(ctx, k.k.opts.DataKeyBits)
+}
+
+// generateDataKey generates a data key of the given size in bits, or of
+// Vault's default size if bits is 0.
+func (k *Key) generateDataKey(ctx context.Context, bits int) (plaintext, ciphertext []byte, err error) {
+	data, err := k.dataKeyRequest(ctx, bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := write(ctx, k.k.client, path.Join("transit/datakey/plaintext", k.k.keyID), data)
+	if err != nil {
+		return nil, nil, wrapError(err)
+	}
+	if secret == nil {
+		return nil, nil, gcerr.Newf(gcerr.NotFound, nil, "vault: transit key %q not found", k.k.keyID)
+	}
+	encoded, _ := secret.Data["plaintext"].(string)
+	wrapped, _ := secret.Data["ciphertext"].(string)
+	if encoded == "" || wrapped == "" {
+		return nil, nil, errors.New("vault: data key response has no plaintext or ciphertext")
+	}
+	plaintext, err = base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, []byte(wrapped), nil
+}
+
+// GenerateWrappedDataKey is like GenerateDataKey, but only returns the data
+// key encrypted with the transit key, for policies that forbid returning data
+// keys in plaintext. The data key can be obtained where it is used with
+// Decrypt on k.Keeper().
+func (k *Key) GenerateWrappedDataKey(ctx context.Context) (ciphertext []byte, err error) {
+	data, err := k.dataKeyRequest(ctx, k.k.opts.DataKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := write(ctx, k.k.client, path.Join("transit/datakey/wrapped", k.k.keyID), data)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if secret == nil {
+		return nil, gcerr.Newf(gcerr.NotFound, nil, "vault: transit key %q not found", k.k.keyID)
+	}
+	wrapped, _ := secret.Data["ciphertext"].(string)
+	if wrapped == "" {
+		return nil, errors.New("vault: data key response has no ciphertext")
+	}
+	return []byte(wrapped), nil
+}
+
+// WrapDataKey is like GenerateDataKey, but Vault responds with a single-use
+// wrapping token valid for KeeperOptions.WrapTTL instead of the data key. The
+// token can be handed off to the consumer of the data key, which retrieves it
+// with Unwrap; the unwrapped data has the base64-encoded data key under
+// "plaintext" and the encrypted data key under "ciphertext".
+func (k *Key) WrapDataKey(ctx context.Context) (token string, err error) {
+	data, err := k.dataKeyRequest(ctx, k.k.opts.DataKeyBits)
+	if err != nil {
+		return "", err
+	}
+	return k.writeWrapped(ctx, path.Join("transit/datakey/plaintext", k.k.keyID), data)
+}
+
+// dataKeyRequest returns the request data to generate a data key of the given
+// size in bits for an operation using ctx.
+func (k *Key) dataKeyRequest(ctx context.Context, bits int) (map[string]interface{}, error) {
+	data := map[string]interface{}{}
+	switch bits {
+	case 0:
+	case 128, 256, 512:
+		data["bits"] = bits
+	default:
+		return nil, fmt.Errorf("vault: invalid data key size %d, want 128, 256 or 512", bits)
+	}
+	if c := k.k.derivationContext(ctx); c != nil {
+		data["context"] = c
+	}
+	return data, nil
+}
+
+// VerifyCapabilities checks that the token of the client may encrypt and
+// decrypt with the key, so that a misconfigured policy is reported at startup
+// rather than by the first operation. If it may not, VerifyCapabilities fails
+// with an error whose code is PermissionDenied, listing the missing
+// capabilities.
+func (k *Key) VerifyCapabilities(ctx context.Context) error {
+	paths := []string{
+		path.Join("transit/encrypt", k.k.keyID),
+		path.Join("transit/decrypt", k.k.keyID),
+	}
+	secret, err := write(ctx, k.k.client, "sys/capabilities-self", map[string]interface{}{
+		"paths": paths,
+	})
+	if err != nil {
+		return wrapError(err)
+	}
+	var missing []string
+	for _, p := range paths {
+		if !hasCapability(secret, p, "update") {
+			missing = append(missing, fmt.Sprintf("%q on %q", "update", p))
+		}
+	}
+	if len(missing) > 0 {
+		return gcerr.Newf(gcerr.PermissionDenied, nil, "vault: token is missing capabilities %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// hasCapability reports whether the response of sys/capabilities-self grants
+// capability c, or root, on path p.
+func hasCapability(secret *api.Secret, p, c string) bool {
+	if secret == nil {
+		return false
+	}
+	caps, _ := secret.Data[p].([]interface{})
+	for _, v := range caps {
+		if s, _ := v.(string); s == c || s == "root" {
+			return true
+		}
+	}
+	return false
+}
+
+// RotateKey adds a new version to the key, which is used by later encryptions.
+// Ciphertexts produced with older versions can still be decrypted; use
+// BatchRewrap to upgrade them.
+func (k *Key) RotateKey(ctx context.Context) error {
+	_, err := write(ctx, k.k.client, path.Join("transit/keys", k.k.keyID, "rotate"), nil)
+	return wrapError(err)
+}
+
+// SetMinDecryptionVersion configures the key so that ciphertexts produced with
+// a key version older than v can no longer be decrypted. Decrypting them fails
+// with an error whose code is FailedPrecondition.
+func (k *Key) SetMinDecryptionVersion(ctx context.Context, v int) error {
+	if v <= 0 {
+		return fmt.Errorf("vault: invalid minimum decryption version %d", v)
+	}
+	_, err := write(ctx, k.k.client, path.Join("transit/keys", k.k.keyID, "config"), map[string]interface{}{
+		"min_decryption_version": v,
+	})
+	return wrapError(err)
+}
+
+// TrimKey permanently deletes the versions of the key older than minVersion.
+// Ciphertexts produced with them can no longer be decrypted. minVersion may
+// not be greater than the minimum decryption version of the key, set with
+// SetMinDecryptionVersion, nor than its minimum encryption version; TrimKey
+// fails with an error whose code is InvalidArgument otherwise.
+func (k *Key) TrimKey(ctx context.Context, minVersion int) error {
+	if minVersion <= 0 {
+		return fmt.Errorf("vault: invalid minimum available version %d", minVersion)
+	}
+	_, err := write(ctx, k.k.client, path.Join("transit/keys", k.k.keyID, "trim"), map[string]interface{}{
+		"min_available_version": minVersion,
+	})
+	return wrapError(err)
+}
+
+// KeyConfig is the configuration of a transit key, set with UpdateKeyConfig.
+type KeyConfig struct {
+	// MinDecryptionVersion is the oldest version of the key that can be used
+	// to decrypt. If 0, it is left unchanged.
+	MinDecryptionVersion int
+	// MinEncryptionVersion is the version of the key used to encrypt, or 0 to
+	// use the latest version.
+	MinEncryptionVersion int
+	// DeletionAllowed allows deleting the key.
+	DeletionAllowed bool
+	// Exportable allows exporting the key with ExportKey. Once a key is
+	// exportable, it cannot be made non-exportable again, so false leaves it
+	// unchanged.
+	Exportable bool
+}
+
+// UpdateKeyConfig sets the configuration of the key to cfg in a single
+// request, so that provisioning scripts can apply it idempotently. The
+// minimum versions may not be greater than the latest version of the key;
+// UpdateKeyConfig fails with an error whose code is InvalidArgument
+// otherwise.
+func (k *Key) UpdateKeyConfig(ctx context.Context, cfg KeyConfig) error {
+	if cfg.MinDecryptionVersion < 0 || cfg.MinEncryptionVersion < 0 {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "vault: invalid key config %+v", cfg)
+	}
+	info, err := ReadKeyInfo(ctx, k.k.client, k.k.keyID)
+	if err != nil {
+		return err
+	}
+	if cfg.MinDecryptionVersion > info.LatestVersion || cfg.MinEncryptionVersion > info.LatestVersion {
+		return gcerr.Newf(gcerr.InvalidArgument, nil, "vault: key config %+v has versions greater than the latest version %d of transit key %q", cfg, info.LatestVersion, k.k.keyID)
+	}
+	data := map[string]interface{}{
+		"min_encryption_version": cfg.MinEncryptionVersion,
+		"deletion_allowed":       cfg.DeletionAllowed,
+	}
+	if cfg.MinDecryptionVersion > 0 {
+		data["min_decryption_version"] = cfg.MinDecryptionVersion
+	}
+	if cfg.Exportable {
+		data["exportable"] = true
+	}
+	_, err = write(ctx, k.k.client, path.Join("transit/keys", k.k.keyID, "config"), data)
+	return wrapError(err)
+}
+
+// ExportKey returns the material of every version of the key, keyed by
+// version. keyType is the type of key to export: "encryption-key",
+// "signing-key" or "hmac-key". Only keys created as exportable can be
+// exported; ExportKey fails with an error whose code is PermissionDenied for
+// other keys.
+func (k *Key) ExportKey(ctx context.Context, keyType string) (map[int]string, error) {
+	p, err := k.exportPath(keyType)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := read(ctx, k.k.client, p)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if secret == nil {
+		return nil, gcerr.Newf(gcerr.NotFound, nil, "vault: transit key %q not found", k.k.keyID)
+	}
+	keys, _ := secret.Data["keys"].(map[string]interface{})
+	versions := make(map[int]string, len(keys))
+	for v, material := range keys {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("vault: invalid key version %q in export", v)
+		}
+		versions[n], _ = material.(string)
+	}
+	return versions, nil
+}
+
+// WrapExportKey is like ExportKey, but Vault responds with a single-use
+// wrapping token valid for KeeperOptions.WrapTTL instead of the key material.
+// The unwrapped data has the material of every version under "keys".
+func (k *Key) WrapExportKey(ctx context.Context, keyType string) (token string, err error) {
+	p, err := k.exportPath(keyType)
+	if err != nil {
+		return "", err
+	}
+	return k.readWrapped(ctx, p)
+}
+
+func (k *Key) exportPath(keyType string) (string, error) {
+	switch keyType {
+	case "encryption-key", "signing-key", "hmac-key":
+		return path.Join("transit/export", keyType, k.k.keyID), nil
+	}
+	return "", fmt.Errorf("vault: invalid export key type %q", keyType)
+}
+
+// readWrapped reads p with a wrapped response and returns the wrapping token.
+func (k *Key) readWrapped(ctx context.Context, p string) (string, error) {
+	return k.wrapped(ctx, http.MethodGet, p, nil)
+}
+
+// writeWrapped writes data to p with a wrapped response and returns the
+// wrapping token.
+func (k *Key) writeWrapped(ctx context.Context, p string, data map[string]interface{}) (string, error) {
+	return k.wrapped(ctx, http.MethodPut, p, data)
+}
+
+func (k *Key) wrapped(ctx context.Context, method, p string, data map[string]interface{}) (string, error) {
+	ttl := k.k.opts.WrapTTL
+	if ttl <= 0 {
+		return "", errors.New("vault: KeeperOptions.WrapTTL must be set to wrap responses")
+	}
+	secret, err := request(ctx, k.k.client, method, p, data, ttl)
+	if err != nil {
+		return "", wrapError(err)
+	}
+	if secret == nil {
+		return "", gcerr.Newf(gcerr.NotFound, nil, "vault: transit key %q not found", k.k.keyID)
+	}
+	if secret.WrapInfo == nil {
+		return "", fmt.Errorf("vault: %s %s: response was not wrapped", method, p)
+	}
+	return secret.WrapInfo.Token, nil
+}
+
+// BatchEncrypt encrypts several plaintexts in a single request to Vault. The
+// returned slice has the ciphertext of plaintexts[i] at index i. If only some
+// of the plaintexts could be encrypted, BatchEncrypt returns the ciphertexts
+// of the others along with a *BatchError reporting the failed ones, whose
+// ciphertexts are nil.
+func (k *Key) BatchEncrypt(ctx context.Context, plaintexts [][]byte) ([][]byte, error) {
+	if err := k.k.checkAssociatedData(ctx); err != nil {
+		return nil, wrapError(err)
+	}
+	items := make([]map[string]interface{}, len(plaintexts))
+	for i, p := range plaintexts {
+		item := map[string]interface{}{
+			"plaintext": base64.StdEncoding.EncodeToString(p),
+		}
+		if c := k.k.derivationContext(ctx); c != nil {
+			item["context"] = base64.StdEncoding.EncodeToString(c)
+		}
+		if k.k.opts.Nonce != nil {
+			item["nonce"] = base64.StdEncoding.EncodeToString(k.k.opts.Nonce)
+		}
+		if ad := associatedData(ctx); ad != nil {
+			item["associated_data"] = base64.StdEncoding.EncodeToString(ad)
+		}
+		if v := k.k.encryptKeyVersion(ctx); v > 0 {
+			item["key_version"] = v
+		}
+		items[i] = item
+	}
+	return k.batch(ctx, "transit/encrypt", "ciphertext", items, func(s string) ([]byte, error) {
+		return []byte(k.k.embedKeyName(s)), nil
+	})
+}
+
+// BatchDecrypt decrypts several ciphertexts in a single request to Vault. The
+// returned slice has the plaintext of ciphertexts[i] at index i. If only some
+// of the ciphertexts could be decrypted, BatchDecrypt returns the plaintexts
+// of the others along with a *BatchError reporting the failed ones, whose
+// plaintexts are nil. Unlike Decrypt, BatchDecrypt always decrypts with the
+// key of k: it fails with an error whose code is InvalidArgument if one of
+// the ciphertexts embeds the name of another key.
+func (k *Key) BatchDecrypt(ctx context.Context, ciphertexts [][]byte) ([][]byte, error) {
+	if err := k.k.checkAssociatedData(ctx); err != nil {
+		return nil, wrapError(err)
+	}
+	items := make([]map[string]interface{}, len(ciphertexts))
+	for i, c := range ciphertexts {
+		c, err := k.batchCiphertext(i, c)
+		if err != nil {
+			return nil, err
+		}
+		item := map[string]interface{}{
+			"ciphertext": string(c),
+		}
+		if c := k.k.derivationContext(ctx); c != nil {
+			item["context"] = base64.StdEncoding.EncodeToString(c)
+		}
+		if ad := associatedData(ctx); ad != nil {
+			item["associated_data"] = base64.StdEncoding.EncodeToString(ad)
+		}
+		items[i] = item
+	}
+	return k.batch(ctx, "transit/decrypt", "plaintext", items, base64.StdEncoding.DecodeString)
+}
+
+// BatchRewrap rewraps several ciphertexts with the latest version of the key in
+// a single request to Vault, without exposing their plaintexts, for example to
+// upgrade the ciphertexts produced with older versions after rotating the key.
+// The returned slice has the rewrapped ciphertext of ciphertexts[i] at index
+// i. If only some of the ciphertexts could be rewrapped, BatchRewrap returns
+// the ciphertexts of the others along with a *BatchError reporting the failed
+// ones, whose ciphertexts are nil. Like BatchDecrypt, it fails with an error
+// whose code is InvalidArgument if one of the ciphertexts embeds the name of
+// another key.
+func (k *Key) BatchRewrap(ctx context.Context, ciphertexts [][]byte) ([][]byte, error) {
+	items := make([]map[string]interface{}, len(ciphertexts))
+	for i, c := range ciphertexts {
+		c, err := k.batchCiphertext(i, c)
+		if err != nil {
+			return nil, err
+		}
+		item := map[string]interface{}{
+			"ciphertext": string(c),
+		}
+		if c := k.k.derivationContext(ctx); c != nil {
+			item["context"] = base64.StdEncoding.EncodeToString(c)
+		}
+		if k.k.opts.Nonce != nil {
+			item["nonce"] = base64.StdEncoding.EncodeToString(k.k.opts.Nonce)
+		}
+		items[i] = item
+	}
+	return k.batch(ctx, "transit/rewrap", "ciphertext", items, func(s string) ([]byte, error) {
+		return []byte(k.k.embedKeyName(s)), nil
+	})
+}
+
+// batchCiphertext returns ciphertexts[i] of a batch without the key name
+// embedded in it with KeeperOptions.EmbedKeyName. Batches are sent to the key
+// of k, so it fails if the ciphertext names another key.
+func (k *Key) batchCiphertext(i int, ciphertext []byte) ([]byte, error) {
+	name, c := splitKeyName(ciphertext)
+	if name != "" && name != k.k.keyID {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "vault: ciphertext %d embeds transit key %q, not %q", i, name, k.k.keyID)
+	}
+	return c, nil
+}
+
+// batch sends items as the batch input of a request to the transit endpoint
+// op, and returns the field of every batch result decoded with decode.
+func (k *Key) batch(ctx context.Context, op, field string, items []map[string]interface{}, decode func(string) ([]byte, error)) ([][]byte, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+	secret, err := write(ctx, k.k.client, path.Join(op, k.k.keyID), map[string]interface{}{
+		"batch_input": items,
+	})
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if secret == nil {
+		return nil, gcerr.Newf(gcerr.NotFound, nil, "vault: transit key %q not found", k.k.keyID)
+	}
+	results, _ := secret.Data["batch_results"].([]interface{})
+	if len(results) != len(items) {
+		return nil, fmt.Errorf("vault: got %d batch results, want %d", len(results), len(items))
+	}
+	out := make([][]byte, len(results))
+	var batchErr BatchError
+	for i, r := range results {
+		result, _ := r.(map[string]interface{})
+		if msg, _ := result["error"].(string); msg != "" {
+			batchErr.Items = append(batchErr.Items, BatchItemError{Index: i, Err: errors.New(msg)})
+			continue
+		}
+		v, _ := result[field].(string)
+		b, err := decode(v)
+		if err != nil {
+			batchErr.Items = append(batchErr.Items, BatchItemError{Index: i, Err: err})
+			continue
+		}
+		out[i] = b
+	}
+	if len(batchErr.Items) > 0 {
+		return out, wrapError(&batchErr)
+	}
+	return out, nil
+}
+
+// BatchError is returned by Key.BatchEncrypt, Key.BatchDecrypt and
+// Key.BatchRewrap when some of the items of a batch failed.
+type BatchError struct {
+	// Items are the failed items, in the order of the batch.
+	Items []BatchItemError
+}
+
+// BatchItemError is the error of a failed item of a batch.
+type BatchItemError struct {
+	// Index is the index of the item in the batch.
+	Index int
+	// Err is the error returned by Vault for the item.
+	Err error
+}
+
+func (e *BatchError) Error() string {
+	msgs := make([]string, len(e.Items))
+	for i, item := range e.Items {
+		msgs[i] = fmt.Sprintf("item %d: %v", item.Index, item.Err)
+	}
+	return fmt.Sprintf("vault: %d batch items failed: %s", len(e.Items), strings.Join(msgs, "; "))
+}
+
+// GenerateRandom returns n cryptographically strong random bytes generated by
+// the Transit Secrets Engine of the Vault server used by client.
+func GenerateRandom(ctx context.Context, client *api.Client, n int) ([]byte, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("vault: invalid number of random bytes %d", n)
+	}
+	secret, err := write(ctx, client, path.Join("transit/random", strconv.Itoa(n)), map[string]interface{}{
+		"format": "base64",
+	})
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if secret == nil {
+		return nil, gcerr.Newf(gcerr.NotFound, nil, "vault: transit/random not found")
+	}
+	b, _ := secret.Data["random_bytes"].(string)
+	if b == "" {
+		return nil, errors.New("vault: random response has no random_bytes")
+	}
+	return base64.StdEncoding.DecodeString(b)
+}
+
+// Unwrap returns the data of the response wrapped in token, such as a token
+// returned by Key.WrapDataKey. The token can only be unwrapped once.
+func Unwrap(ctx context.Context, client *api.Client, token string) (map[string]interface{}, error) {
+	secret, err := write(ctx, client, "sys/wrapping/unwrap", map[string]interface{}{
+		"token": token,
+	})
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if secret == nil {
+		return nil, nil
+	}
+	return secret.Data, nil
+}
+
+// ListKeys returns the names of the transit keys of the Vault server used by
+// client.
+func ListKeys(ctx context.Context, client *api.Client) ([]string, error) {
+	// Vault takes a GET with list=true as a LIST, like api.Logical().List
+	// sends it; unlike LIST, it is cached when Config.KeyInfoTTL is set.
+	secret, err := requestWithParams(ctx, client, http.MethodGet, "transit/keys", url.Values{"list": {"true"}}, nil, 0)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if secret == nil {
+		// Vault responds with 404 when there are no keys.
+		return nil, nil
+	}
+	keys, _ := secret.Data["keys"].([]interface{})
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if name, ok := k.(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// KeyInfo describes a transit key.
+type KeyInfo struct {
+	// Name is the name of the key.
+	Name string
+	// Type is the type of the key, such as "aes256-gcm96".
+	Type string
+	// LatestVersion is the version of the key used to encrypt, unless
+	// MinEncryptionVersion is greater.
+	LatestVersion int
+	// MinDecryptionVersion is the oldest version of the key that can be used
+	// to decrypt.
+	MinDecryptionVersion int
+	// MinEncryptionVersion is the oldest version of the key that can be used
+	// to encrypt, or 0 to always use the latest version.
+	MinEncryptionVersion int
+	// Derived, Exportable and DeletionAllowed report the corresponding
+	// properties of the key; see KeeperOptions.
+	Derived, Exportable, DeletionAllowed bool
+}
+
+// ReadKeyInfo returns the description of the transit key name of the Vault
+// server used by client.
+func ReadKeyInfo(ctx context.Context, client *api.Client, name string) (*KeyInfo, error) {
+	secret, err := read(ctx, client, path.Join("transit/keys", name))
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if secret == nil {
+		return nil, gcerr.Newf(gcerr.NotFound, nil, "vault: transit key %q not found", name)
+	}
+	d := secret.Data
+	info := &KeyInfo{Name: name}
+	info.Type, _ = d["type"].(string)
+	info.Derived, _ = d["derived"].(bool)
+	info.Exportable, _ = d["exportable"].(bool)
+	info.DeletionAllowed, _ = d["deletion_allowed"].(bool)
+	for _, f := range []struct {
+		name string
+		v    *int
+	}{
+		{"latest_version", &info.LatestVersion},
+		{"min_decryption_version", &info.MinDecryptionVersion},
+		{"min_encryption_version", &info.MinEncryptionVersion},
+	} {
+		n, ok := d[f.name].(json.Number)
+		if !ok {
+			continue
+		}
+		v, err := n.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("vault: invalid %s %q for transit key %q", f.name, n, name)
+		}
+		*f.v = int(v)
+	}
+	return info, nil
+}
+
+// KeyVersion returns the version of the transit key that was used to produce
+// ciphertext, which must have been returned by Encrypt.
+func KeyVersion(ciphertext []byte) (int, error) {
+	_, ciphertext = splitKeyName(ciphertext)
+	parts := strings.SplitN(string(ciphertext), ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" || !strings.HasPrefix(parts[1], "v") {
+		return 0, errors.New("vault: ciphertext is not in the Vault transit format")
+	}
+	v, err := strconv.Atoi(parts[1][1:])
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("vault: invalid key version %q in ciphertext", parts[1])
+	}
+	return v, nil
+}
+
+// wrapError wraps an error returned while talking to Vault from a function
+// that is not part of the driver, so that gcerrors.Code can report its code.
+func wrapError(err error) error {
+	if err == nil || gcerr.DoNotWrap(err) {
+		return err
+	}
+	return gcerr.New(errorCode(err), err, 2, "vault")
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"gocloud.dev/internal/gcerr"
+)
+
+// ReadSecret returns the data of the latest version of the secret at path in
+// a version 2 KV Secrets Engine of the Vault server used by client. path starts
+// with the mount path of the engine, as in "secret/myapp/db"; the "data/"
+// segment of the KV v2 API is added by ReadSecret.
+//
+// ReadSecret fails with an error whose code is NotFound if there is no such
+// secret, or if its latest version was deleted.
+func ReadSecret(ctx context.Context, client *api.Client, path string) (map[string]interface{}, error) {
+	return ReadSecretVersion(ctx, client, path, 0)
+}
+
+// ReadSecretVersion is like ReadSecret, but returns the data of the given
+// version of the secret. A version of 0 reads the latest version.
+func ReadSecretVersion(ctx context.Context, client *api.Client, path string, version int) (map[string]interface{}, error) {
+	if version < 0 {
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "vault: invalid secret version %d", version)
+	}
+	p, err := kvDataPath(path)
+	if err != nil {
+		return nil, err
+	}
+	var params url.Values
+	if version > 0 {
+		params = url.Values{"version": {strconv.Itoa(version)}}
+	}
+	secret, err := requestWithParams(ctx, client, http.MethodGet, p, params, nil, 0)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if secret == nil {
+		return nil, gcerr.Newf(gcerr.NotFound, nil, "vault: secret %q not found", path)
+	}
+	// The secret itself is nested under "data", next to its "metadata". It is
+	// null for a deleted or destroyed version.
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		return nil, gcerr.Newf(gcerr.NotFound, nil, "vault: secret %q has no data", path)
+	}
+	return data, nil
+}
+
+// kvDataPath returns the path of the KV v2 API that holds the data of the
+// secret at p, inserting "data" after the mount path.
+func kvDataPath(p string) (string, error) {
+	p = strings.Trim(p, "/")
+	parts := strings.SplitN(p, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", gcerr.Newf(gcerr.InvalidArgument, nil, "vault: invalid secret path %q, want <mount>/<path>", p)
+	}
+	return fmt.Sprintf("%s/data/%s", parts[0], parts[1]), nil
+}
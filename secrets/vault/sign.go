@@ -0,0 +1,224 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"gocloud.dev/internal/gcerr"
+)
+
+// SignOptions controls how Key.Sign signs and Key.Verify verifies input.
+type SignOptions struct {
+	// HashAlgorithm is the hash function applied to the input: "sha2-224",
+	// "sha2-256", "sha2-384" or "sha2-512". Defaults to "sha2-256". It is
+	// ignored for "ed25519" keys.
+	HashAlgorithm string
+
+	// SignatureAlgorithm is the signature algorithm used with RSA keys: "pss"
+	// or "pkcs1v15". Defaults to "pss".
+	SignatureAlgorithm string
+
+	// Prehashed means that the input is already the digest of the content to
+	// sign, computed with HashAlgorithm, rather than the content itself. The
+	// input must then be exactly as long as a digest of HashAlgorithm. It is
+	// not supported for "ed25519" keys.
+	Prehashed bool
+
+	// SignatureFormat is the format of the signatures returned by Sign and
+	// accepted by Verify. Defaults to SignatureVault.
+	SignatureFormat SignatureFormat
+
+	// KeyVersion is the version of the key that produced the signature given
+	// to Verify in a format other than SignatureVault, which does not record
+	// it. Defaults to the latest version of the key.
+	KeyVersion int
+}
+
+// SignatureFormat is the format of signatures produced by Key.Sign.
+type SignatureFormat string
+
+const (
+	// SignatureVault is the format of Vault, "vault:v<version>:" followed by
+	// the signature in base64. For ECDSA keys, the signature is ASN.1 DER
+	// encoded.
+	SignatureVault SignatureFormat = ""
+	// SignatureDER is the signature alone, as raw bytes: ASN.1 DER encoded for
+	// ECDSA keys, as expected by most verifiers outside Vault.
+	SignatureDER SignatureFormat = "der"
+	// SignatureJWS is the signature of an ECDSA key in the format of JSON Web
+	// Signatures, the concatenation of r and s, encoded in unpadded base64url.
+	// It is not supported for other key types.
+	SignatureJWS SignatureFormat = "jws"
+)
+
+// digestSizes are the sizes in bytes of the digests of the hash algorithms
+// supported by Vault.
+var digestSizes = map[string]int{
+	"sha2-224": 28,
+	"sha2-256": 32,
+	"sha2-384": 48,
+	"sha2-512": 64,
+}
+
+// request returns the request data for signing or verifying input with o,
+// with the key derivation context c if it is not nil.
+func (o *SignOptions) request(input, c []byte) (map[string]interface{}, error) {
+	data := map[string]interface{}{
+		"input": base64.StdEncoding.EncodeToString(input),
+	}
+	if c != nil {
+		data["context"] = base64.StdEncoding.EncodeToString(c)
+	}
+	if o == nil {
+		return data, nil
+	}
+	if o.HashAlgorithm != "" {
+		data["hash_algorithm"] = o.HashAlgorithm
+	}
+	if o.SignatureAlgorithm != "" {
+		data["signature_algorithm"] = o.SignatureAlgorithm
+	}
+	switch o.SignatureFormat {
+	case SignatureVault, SignatureDER:
+	case SignatureJWS:
+		data["marshaling_algorithm"] = "jws"
+	default:
+		return nil, gcerr.Newf(gcerr.InvalidArgument, nil, "vault: unknown signature format %q", o.SignatureFormat)
+	}
+	if o.Prehashed {
+		hash := o.HashAlgorithm
+		if hash == "" {
+			hash = "sha2-256"
+		}
+		size, ok := digestSizes[hash]
+		if !ok {
+			return nil, fmt.Errorf("vault: unknown hash algorithm %q", hash)
+		}
+		if len(input) != size {
+			return nil, fmt.Errorf("vault: prehashed input of %d bytes, want a %s digest of %d bytes", len(input), hash, size)
+		}
+		data["prehashed"] = true
+	}
+	return data, nil
+}
+
+// Sign signs input with the key, which must be of a type that supports
+// signing, such as "ed25519", "ecdsa-p256" or "rsa-2048". opts may be nil to
+// use the defaults. Signing with a key that does not support it fails with an
+// error whose code is FailedPrecondition.
+//
+// The key derivation context of the keeper, KeeperOptions.Context or the one
+// set with WithDerivationContext, is used to sign with a derived key, so that
+// the signature only verifies with the same context. The key must then have
+// been created with key derivation enabled; Sign fails with an error whose
+// code is FailedPrecondition otherwise.
+func (k *Key) Sign(ctx context.Context, input []byte, opts *SignOptions) (signature []byte, err error) {
+	data, err := k.signRequest(ctx, input, opts)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := write(ctx, k.k.client, path.Join("transit/sign", k.k.keyID), data)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	if secret == nil {
+		return nil, gcerr.Newf(gcerr.NotFound, nil, "vault: transit key %q not found", k.k.keyID)
+	}
+	sig, _ := secret.Data["signature"].(string)
+	if sig == "" {
+		return nil, errors.New("vault: sign response has no signature")
+	}
+	if opts == nil || opts.SignatureFormat == SignatureVault {
+		return []byte(sig), nil
+	}
+	parts := strings.SplitN(sig, ":", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("vault: signature %q is not in the Vault format", sig)
+	}
+	if opts.SignatureFormat == SignatureJWS {
+		return []byte(parts[2]), nil
+	}
+	return base64.StdEncoding.DecodeString(parts[2])
+}
+
+// Verify reports whether signature, returned by Sign, is a valid signature of
+// input. opts must match the options used to sign; with different options,
+// such as another signature algorithm or key derivation context, Verify
+// reports false.
+func (k *Key) Verify(ctx context.Context, input, signature []byte, opts *SignOptions) (bool, error) {
+	data, err := k.signRequest(ctx, input, opts)
+	if err != nil {
+		return false, err
+	}
+	sig, err := k.vaultSignature(ctx, signature, opts)
+	if err != nil {
+		return false, err
+	}
+	data["signature"] = sig
+	secret, err := write(ctx, k.k.client, path.Join("transit/verify", k.k.keyID), data)
+	if err != nil {
+		return false, wrapError(err)
+	}
+	if secret == nil {
+		return false, gcerr.Newf(gcerr.NotFound, nil, "vault: transit key %q not found", k.k.keyID)
+	}
+	valid, _ := secret.Data["valid"].(bool)
+	return valid, nil
+}
+
+// vaultSignature returns signature, in the format of opts, in the format of
+// Vault.
+func (k *Key) vaultSignature(ctx context.Context, signature []byte, opts *SignOptions) (string, error) {
+	if opts == nil || opts.SignatureFormat == SignatureVault {
+		return string(signature), nil
+	}
+	v := opts.KeyVersion
+	if v <= 0 {
+		info, err := ReadKeyInfo(ctx, k.k.client, k.k.keyID)
+		if err != nil {
+			return "", err
+		}
+		v = info.LatestVersion
+	}
+	sig := string(signature)
+	if opts.SignatureFormat == SignatureDER {
+		sig = base64.StdEncoding.EncodeToString(signature)
+	}
+	return fmt.Sprintf("vault:v%d:%s", v, sig), nil
+}
+
+// signRequest returns the request data for signing or verifying input with
+// opts in an operation using ctx. If the operation has a key derivation
+// context, it checks that the key was created with key derivation enabled:
+// Vault would silently ignore the context otherwise.
+func (k *Key) signRequest(ctx context.Context, input []byte, opts *SignOptions) (map[string]interface{}, error) {
+	c := k.k.derivationContext(ctx)
+	if c != nil {
+		info, err := ReadKeyInfo(ctx, k.k.client, k.k.keyID)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Derived {
+			return nil, gcerr.Newf(gcerr.FailedPrecondition, nil, "vault: transit key %q was not created with key derivation enabled, so it cannot sign with a context", k.k.keyID)
+		}
+	}
+	return opts.request(input, c)
+}
@@ -0,0 +1,467 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	gax "github.com/googleapis/gax-go"
+	"github.com/hashicorp/vault/api"
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/trace"
+	"gocloud.dev/internal/retry"
+	"golang.org/x/sync/singleflight"
+)
+
+// RetryPolicy controls how requests that Vault rejects with a transient error
+// (429, 502 or 503) are retried. Retries use jittered exponential backoff and
+// stop when the request's context is done.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts for a request, including
+	// the first one. Defaults to 3.
+	MaxAttempts int
+
+	// BaseBackoff is the backoff before the first retry. Defaults to 100ms.
+	BaseBackoff time.Duration
+
+	// MaxBackoff is the maximum backoff between two attempts. Defaults to 5s.
+	MaxBackoff time.Duration
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return 3
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) backoff() gax.Backoff {
+	bo := gax.Backoff{
+		Initial:    p.BaseBackoff,
+		Max:        p.MaxBackoff,
+		Multiplier: 2,
+	}
+	if bo.Initial <= 0 {
+		bo.Initial = 100 * time.Millisecond
+	}
+	if bo.Max <= 0 {
+		bo.Max = 5 * time.Second
+	}
+	return bo
+}
+
+// isTransientStatus reports whether Vault responding with the HTTP status code
+// indicates a condition that may be corrected by retrying.
+func isTransientStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// isSealed reports whether resp is the response of a sealed Vault server,
+// which needs to be unsealed rather than retried. The body of resp is left
+// unread.
+func isSealed(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		return false
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+	return err == nil && bytes.Contains(b, []byte(errSealed))
+}
+
+// retriesExhaustedError is returned when a request still failed with a
+// transient error after all the attempts allowed by the RetryPolicy.
+type retriesExhaustedError struct {
+	attempts int
+	status   string
+}
+
+func (e *retriesExhaustedError) Error() string {
+	return fmt.Sprintf("vault: giving up after %d attempts, last response: %s", e.attempts, e.status)
+}
+
+// transientError is used to signal retry.Call that an attempt should be
+// retried.
+type transientError struct{ status string }
+
+func (e *transientError) Error() string { return e.status }
+
+// transport is an http.RoundTripper that adds the behaviors configured in
+// Config to every request made by the Vault client.
+type transport struct {
+	base  http.RoundTripper
+	retry *RetryPolicy
+	// addresses are the Vault servers to try in order; see Config.Addresses.
+	addresses []*url.URL
+	// client and auth are set when client was created with an auth method, to
+	// log in again when Vault rejects the token.
+	client *api.Client
+	auth   authenticator
+	group  singleflight.Group
+	logger Logger
+	// observer is Config.RequestObserver.
+	observer func(op string, d time.Duration, err error)
+	// cache, if not nil, caches transit key metadata; see Config.KeyInfoTTL.
+	cache *metadataCache
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.cache == nil || !isKeyMetadataPath(req.URL.Path) {
+		return t.observe(req)
+	}
+	if req.Method != http.MethodGet {
+		// Writes, such as rotating a key or updating its configuration, may
+		// change the metadata. Reads made while the write is in flight may
+		// see the old metadata, so the cache is cleared again after it.
+		t.cache.clear()
+		defer t.cache.clear()
+		return t.observe(req)
+	}
+	key := req.Header.Get("X-Vault-Token") + " " + req.URL.String()
+	if resp := t.cache.get(key, req); resp != nil {
+		return resp, nil
+	}
+	resp, err := t.observe(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	t.cache.put(key, resp, body)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// isKeyMetadataPath reports whether the request path p is under the transit
+// key metadata endpoints, such as /v1/transit/keys/<key>.
+func isKeyMetadataPath(p string) bool {
+	return p == "/v1/transit/keys" || strings.HasPrefix(p, "/v1/transit/keys/")
+}
+
+// metadataCache caches the successful responses of Vault to reads of transit
+// key metadata for ttl.
+type metadataCache struct {
+	ttl time.Duration
+	// now returns the current time; it defaults to time.Now and is swapped in
+	// tests.
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+// cachedResponse is a response cached by metadataCache.
+type cachedResponse struct {
+	status  string
+	code    int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newMetadataCache(ttl time.Duration) *metadataCache {
+	return &metadataCache{ttl: ttl, now: time.Now, entries: map[string]*cachedResponse{}}
+}
+
+// get returns the cached response to req under key, or nil if there is none
+// or it has expired.
+func (c *metadataCache) get(key string, req *http.Request) *http.Response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if !c.now().Before(e.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	header := make(http.Header, len(e.header))
+	for k, v := range e.header {
+		header[k] = v
+	}
+	return &http.Response{
+		Status:        e.status,
+		StatusCode:    e.code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// put caches resp, whose body is body, under key.
+func (c *metadataCache) put(key string, resp *http.Response, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = &cachedResponse{
+		status:  resp.Status,
+		code:    resp.StatusCode,
+		header:  resp.Header,
+		body:    body,
+		expires: c.now().Add(c.ttl),
+	}
+}
+
+// clear removes all the cached responses.
+func (c *metadataCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*cachedResponse{}
+}
+
+// observe sends req, reporting it to the observer of t if it is a request to
+// the Transit Secrets Engine.
+func (t *transport) observe(req *http.Request) (*http.Response, error) {
+	if t.observer == nil {
+		return t.roundTripAuth(req)
+	}
+	op, ok := transitOp(req.URL.Path)
+	if !ok {
+		return t.roundTripAuth(req)
+	}
+	start := time.Now()
+	resp, err := t.roundTripAuth(req)
+	observed := err
+	if err == nil && resp.StatusCode >= 400 {
+		observed = fmt.Errorf("vault: response %s", resp.Status)
+	}
+	t.observer(op, time.Since(start), observed)
+	return resp, err
+}
+
+// transitOp returns the operation of the Transit Secrets Engine that is the
+// request path p, such as "encrypt" for /v1/transit/encrypt/<key>.
+func transitOp(p string) (string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/v1/"), "/", 3)
+	if len(parts) < 2 || parts[0] != "transit" || parts[1] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// roundTripAuth sends req, logging in again and retrying once if Vault
+// rejects its token.
+func (t *transport) roundTripAuth(req *http.Request) (*http.Response, error) {
+	if span := trace.FromContext(req.Context()); span != nil {
+		req = withTraceContext(req, span.SpanContext())
+	}
+	if t.retry == nil && len(t.addresses) < 2 && t.auth == nil {
+		return t.base.RoundTrip(req)
+	}
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.roundTrip(req, body)
+	if err != nil || resp.StatusCode != http.StatusForbidden || t.auth == nil || req.Context().Value(loginKey{}) != nil {
+		return resp, err
+	}
+	// The token may have been revoked or have expired: log in again and
+	// retry once.
+	discard(resp)
+	logf(t.logger, "vault: %s %s: token rejected, logging in again with the %s auth method", req.Method, req.URL.Path, t.auth.name())
+	token, err := t.reauthenticate(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	return t.roundTrip(withToken(req, token), body)
+}
+
+// reauthenticate logs in again with the auth method of the client and makes
+// it use the new token, which is returned. Concurrent calls share a single
+// login.
+func (t *transport) reauthenticate(ctx context.Context) (string, error) {
+	v, err, _ := t.group.Do("login", func() (interface{}, error) {
+		token, err := t.auth.login(ctx, t.client)
+		if err != nil {
+			return "", err
+		}
+		t.client.SetToken(token)
+		return token, nil
+	})
+	return v.(string), err
+}
+
+// roundTrip sends req with the given body, retrying according to the retry
+// policy of t.
+func (t *transport) roundTrip(req *http.Request, body []byte) (*http.Response, error) {
+	if t.retry == nil {
+		return t.send(req, body)
+	}
+	var (
+		resp     *http.Response
+		attempts int
+		max      = t.retry.maxAttempts()
+	)
+	isRetryable := func(err error) bool {
+		_, ok := err.(*transientError)
+		return ok
+	}
+	err := retry.Call(req.Context(), t.retry.backoff(), isRetryable, func() error {
+		attempts++
+		var err error
+		resp, err = t.send(req, body)
+		if err != nil {
+			return err
+		}
+		if !isTransientStatus(resp.StatusCode) || isSealed(resp) {
+			return nil
+		}
+		status := resp.Status
+		if attempts >= max {
+			resp.Body.Close()
+			resp = nil
+			return &retriesExhaustedError{attempts: attempts, status: status}
+		}
+		discard(resp)
+		resp = nil
+		logf(t.logger, "vault: %s %s: response %s, retrying (attempt %d of %d)", req.Method, req.URL.Path, status, attempts, max)
+		return &transientError{status: status}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// closeIdleConnections closes the idle connections of the underlying
+// transport, if it supports it.
+func (t *transport) closeIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// send sends req with the given body. If several addresses are configured,
+// they are tried in order, moving on to the next one when a server cannot be
+// reached or responds that it is unavailable (for example, because it is a
+// standby node).
+func (t *transport) send(req *http.Request, body []byte) (*http.Response, error) {
+	if len(t.addresses) == 0 {
+		return t.base.RoundTrip(withBody(req, body))
+	}
+	var (
+		resp *http.Response
+		err  error
+	)
+	for i, addr := range t.addresses {
+		r := withBody(req, body)
+		u := *req.URL
+		u.Scheme, u.Host = addr.Scheme, addr.Host
+		r.URL, r.Host = &u, addr.Host
+		resp, err = t.base.RoundTrip(r)
+		if i == len(t.addresses)-1 || req.Context().Err() != nil {
+			break
+		}
+		if err == nil && resp.StatusCode != http.StatusServiceUnavailable {
+			break
+		}
+		if err == nil {
+			discard(resp)
+		}
+	}
+	return resp, err
+}
+
+// discard drains and closes the body of resp, so that its connection can be
+// reused.
+func discard(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// readBody reads and closes the body of req, so that it can be sent again on
+// retries.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	defer req.Body.Close()
+	return ioutil.ReadAll(req.Body)
+}
+
+// withBody returns a shallow copy of req with its body set to body.
+func withBody(req *http.Request, body []byte) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	if body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return r
+}
+
+// withTraceContext returns a shallow copy of req with the trace context sc
+// set in its headers.
+func withTraceContext(req *http.Request, sc trace.SpanContext) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	traceFormat.SpanContextToRequest(sc, r)
+	return r
+}
+
+// withToken returns a shallow copy of req that authenticates with token.
+func withToken(req *http.Request, token string) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("X-Vault-Token", token)
+	return r
+}
+
+// redactURL returns rawurl with the password in it, if any, redacted, for
+// logging.
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.User == nil {
+		return rawurl
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// traceFormat is the format of the trace context sent to Vault.
+var traceFormat = &tracecontext.HTTPFormat{}
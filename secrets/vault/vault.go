@@ -22,29 +22,51 @@
 // start with "vault://". secrets.OpenKeeper will dial a Vault server once per
 // unique combination of the following supported URL parameters:
 //   - address: Sets Config.APIConfig.Address; should be a full URL with the
-//       address of the Vault server.
+//       address of the Vault server. A comma-separated list of addresses sets
+//       Config.Addresses instead.
 //   - token: Sets Config.Token; the access token the Vault client will use.
+//   - header: Adds an entry to Config.Headers, formatted as "Name:Value". May
+//       be repeated.
+//
+// Alternatively, the "client" URL parameter names a client registered with
+// RegisterClient, which is used instead of dialing; it may not be combined
+// with the parameters above.
 // Example URL: "vault://mykey?address=http://vault.server.com:8080&token=aaaaa".
 //
+// Transit operations
+//
+// Use NewKey to access operations of the Transit Secrets Engine that are not
+// part of the portable *secrets.Keeper API, such as generating data keys for
+// envelope encryption.
+//
 // As
 //
-// vault does not support any types for As.
+// vault exposes the following types for As:
+//  - Keeper: *api.Client
+//  - Error: *ResponseError, *BatchError
 package vault
 
 import (
+	"bytes"
+	"container/list"
 	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"path"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/vault/api"
+	"go.opencensus.io/trace"
 	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/gcerr"
 	"gocloud.dev/secrets"
+	"golang.org/x/sync/singleflight"
 )
 
 // Config is the authentication configurations of the Vault server.
@@ -55,39 +77,329 @@ type Config struct {
 	Token string
 	// APIConfig is used to configure the creation of the client.
 	APIConfig api.Config
+	// RetryPolicy controls retries of requests that fail with a transient
+	// error. If nil, requests are not retried.
+	RetryPolicy *RetryPolicy
+	// Addresses lists the full URLs of several Vault servers, such as the
+	// nodes of an HA cluster. Each request is sent to them in order, moving on
+	// to the next one when a server cannot be reached or responds with 503.
+	// If set, it takes precedence over APIConfig.Address.
+	Addresses []string
+	// Headers are added to every request made to Vault, for example to
+	// authenticate with a proxy in front of it. Headers used by Vault itself,
+	// such as X-Vault-Token, may not be set here.
+	Headers map[string]string
+	// Userpass, if set, makes Dial log in with the userpass auth method and
+	// use the resulting token instead of Token.
+	Userpass *UserpassAuth
+	// AppRole, if set, makes Dial log in with the AppRole auth method and use
+	// the resulting token instead of Token.
+	AppRole *AppRoleAuth
+	// Logger, if set, receives messages about the client being created, auth
+	// method logins and retried requests. Tokens and credentials are never
+	// logged.
+	Logger Logger
+	// RequestObserver, if set, is called after each request to the Transit
+	// Secrets Engine with its operation, such as "encrypt" or "decrypt", the
+	// time it took including retries, and the error it failed with, if any,
+	// for example to tell time spent in Vault from time spent elsewhere
+	// without enabling tracing. It must be safe for concurrent use.
+	RequestObserver func(op string, d time.Duration, err error)
+	// KeyInfoTTL, if positive, makes the client cache the transit key
+	// metadata read by ReadKeyInfo and ListKeys for this long, for example
+	// for dashboards polling it. Any change made through the client to a
+	// key, such as with RotateKey or UpdateKeyConfig, clears the cache;
+	// changes made by other clients may take up to KeyInfoTTL to be seen.
+	KeyInfoTTL time.Duration
+}
+
+// Logger receives log messages. *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// logf logs a message to l if it is not nil.
+func logf(l Logger, format string, v ...interface{}) {
+	if l != nil {
+		l.Printf(format, v...)
+	}
+}
+
+// reservedHeaders are the headers that may not be set through Config.Headers.
+var reservedHeaders = map[string]bool{
+	"X-Vault-Token":     true,
+	"X-Vault-Namespace": true,
+	"X-Vault-Wrap-Ttl":  true,
+	"X-Vault-Mfa":       true,
 }
 
 // Dial gets a Vault client.
+//
+// If cfg configures an auth method, such as Userpass or AppRole, a request
+// that Vault rejects with 403, for example because the token was revoked or
+// has expired, makes the client log in again and retry the request once with
+// the new token.
+//
+// Dial does not modify cfg, so that the same Config can be dialed several
+// times.
 func Dial(ctx context.Context, cfg *Config) (*api.Client, error) {
+	c, _, err := dial(ctx, cfg)
+	return c, err
+}
+
+// dial is like Dial, but also returns the HTTP client of the Vault client.
+func dial(ctx context.Context, cfg *Config) (*api.Client, *http.Client, error) {
 	if cfg == nil {
-		return nil, errors.New("no auth Config provided")
+		return nil, nil, errors.New("no auth Config provided")
+	}
+	var addrs []*url.URL
+	for _, a := range cfg.Addresses {
+		u, err := url.Parse(a)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid Vault address %q: %v", a, err)
+		}
+		addrs = append(addrs, u)
+	}
+	// api.NewClient fills in the config it is given, and the transport is
+	// installed in its HTTP client, so they are copied. api.Config holds a
+	// lock, so it is copied field by field.
+	apiCfg := &api.Config{
+		Address:    cfg.APIConfig.Address,
+		HttpClient: cfg.APIConfig.HttpClient,
+		MaxRetries: cfg.APIConfig.MaxRetries,
+		Timeout:    cfg.APIConfig.Timeout,
+		Error:      cfg.APIConfig.Error,
+		Backoff:    cfg.APIConfig.Backoff,
+		Limiter:    cfg.APIConfig.Limiter,
+	}
+	if len(addrs) > 0 {
+		apiCfg.Address = cfg.Addresses[0]
 	}
-	c, err := api.NewClient(&cfg.APIConfig)
+	headers := http.Header{}
+	for name, value := range cfg.Headers {
+		name = http.CanonicalHeaderKey(name)
+		if reservedHeaders[name] {
+			return nil, nil, fmt.Errorf("header %q is reserved and cannot be set in Config.Headers", name)
+		}
+		headers.Set(name, value)
+	}
+	if hc := apiCfg.HttpClient; hc != nil {
+		hc2 := *hc
+		apiCfg.HttpClient = &hc2
+	}
+	c, err := api.NewClient(apiCfg)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	hc := apiCfg.HttpClient
+	t := &transport{
+		base:      hc.Transport,
+		retry:     cfg.RetryPolicy,
+		addresses: addrs,
+		logger:    cfg.Logger,
+		observer:  cfg.RequestObserver,
+	}
+	if cfg.KeyInfoTTL > 0 {
+		t.cache = newMetadataCache(cfg.KeyInfoTTL)
+	}
+	hc.Transport = t
+	if cfg.RetryPolicy != nil {
+		// Retries are handled by our transport.
+		c.SetMaxRetries(0)
+	}
+	if len(headers) > 0 {
+		c.SetHeaders(headers)
 	}
 	if cfg.Token != "" {
 		c.SetToken(cfg.Token)
 	}
-	return c, nil
+	if auth := cfg.authMethod(); auth != nil {
+		token, err := auth.login(ctx, c)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.SetToken(token)
+		t.client, t.auth = c, auth
+		logf(cfg.Logger, "vault: logged in with the %s auth method", auth.name())
+	}
+	logf(cfg.Logger, "vault: created client for %s", redactURL(c.Address()))
+	return c, hc, nil
+}
+
+// CheckHealth reports whether the Vault server used by client can serve
+// requests. It returns an error if the server is uninitialized, sealed or in
+// standby mode. Use gcerrors.Code to get the category of the error: the code
+// is FailedPrecondition for an uninitialized or sealed server, which must be
+// fixed by an operator, and Unavailable for a standby server, for which
+// requests should go to the active node.
+func CheckHealth(ctx context.Context, client *api.Client) error {
+	h, err := health(ctx, client)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return gcerr.New(gcerrors.Unavailable, err, 1, "vault: health check failed")
+	}
+	switch {
+	case !h.Initialized:
+		return gcerr.Newf(gcerrors.FailedPrecondition, nil, "vault: server is not initialized")
+	case h.Sealed:
+		return gcerr.Newf(gcerrors.FailedPrecondition, nil, "vault: server is sealed and must be unsealed")
+	case h.Standby:
+		return gcerr.Newf(gcerrors.Unavailable, nil, "vault: server is in standby mode; fail over to the active node")
+	}
+	return nil
+}
+
+// health reads the health of the Vault server used by client. Vault answers
+// the request with a 200 whatever its state, so that the health is always
+// in the body rather than in an error response.
+func health(ctx context.Context, client *api.Client) (*api.HealthResponse, error) {
+	r := client.NewRequest(http.MethodGet, "/v1/sys/health")
+	for _, p := range []string{"standbycode", "perfstandbycode", "sealedcode", "uninitcode"} {
+		r.Params.Set(p, "200")
+	}
+	resp, err := client.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	var h api.HealthResponse
+	if err := resp.DecodeJSON(&h); err != nil {
+		return nil, err
+	}
+	return &h, nil
 }
 
 func init() {
-	secrets.DefaultURLMux().RegisterKeeper(Scheme, new(lazyDialer))
+	secrets.DefaultURLMux().RegisterKeeper(Scheme, defaultDialer)
+}
+
+// ConnectionOptions controls how the Vault clients dialed when opening
+// keepers with secrets.OpenKeeper are cached.
+type ConnectionOptions struct {
+	// MaxCachedClients is the maximum number of clients kept in the cache. When
+	// the cache is full, the least recently used client is evicted and its idle
+	// connections are closed. Defaults to 64.
+	MaxCachedClients int
+
+	// ClientTTL is how long a cached client is used for. A client older than
+	// ClientTTL is dialed again on next use, which picks up a fresh token for
+	// short-lived tokens. Defaults to 0, meaning that clients do not expire.
+	ClientTTL time.Duration
+}
+
+func (o *ConnectionOptions) maxCachedClients() int {
+	if o.MaxCachedClients <= 0 {
+		return 64
+	}
+	return o.MaxCachedClients
+}
+
+// SetConnectionOptions sets the options used for the clients dialed by the URL
+// opener registered on secrets.DefaultURLMux. It only affects keepers opened
+// afterwards.
+func SetConnectionOptions(opts ConnectionOptions) {
+	defaultDialer.mu.Lock()
+	defer defaultDialer.mu.Unlock()
+	defaultDialer.opts = opts
+}
+
+// RegisterClient registers client under name for the URL opener registered on
+// secrets.DefaultURLMux, so that URLs with the "client" parameter set to name
+// open keepers that use client instead of dialing Vault. Use it to share a
+// client authenticated by the application in its own way. Registering another
+// client under the same name replaces it, and a nil client unregisters the
+// name.
+func RegisterClient(name string, client *api.Client) {
+	defaultDialer.register(name, client)
+}
+
+var defaultDialer = new(lazyDialer)
+
+// CloseCachedClients closes the idle connections of the clients dialed for
+// the keepers opened by URL on secrets.DefaultURLMux, and removes them from
+// the cache, so that they don't outlive the keepers, for example in tests
+// that open many keepers. Keepers opened before keep working; their later
+// requests open new connections. Clients registered with RegisterClient are
+// not affected.
+func CloseCachedClients() {
+	defaultDialer.close()
 }
 
 // lazyDialer lazily dials unique Vault servers.
 type lazyDialer struct {
-	mu      sync.Mutex
-	clients map[string]*api.Client
+	// group ensures that a single client is dialed for concurrent opens of
+	// the same server.
+	group singleflight.Group
+
+	mu   sync.Mutex
+	opts ConnectionOptions
+	// clients maps cache keys to elements of lru, which holds *cacheEntry
+	// values from the most to the least recently used.
+	clients map[string]*list.Element
+	lru     *list.List
+	// registered maps names to the clients registered with RegisterClient.
+	registered map[string]*api.Client
+	// now returns the current time; it defaults to time.Now and is swapped in
+	// tests.
+	now func() time.Time
 }
 
-func (o *lazyDialer) cachedClient(ctx context.Context, u *url.URL) (*api.Client, *url.URL, error) {
+// register registers client under name, or unregisters name if client is nil.
+func (o *lazyDialer) register(name string, client *api.Client) {
 	o.mu.Lock()
 	defer o.mu.Unlock()
-	if o.clients == nil {
-		o.clients = map[string]*api.Client{}
+	if client == nil {
+		delete(o.registered, name)
+		return
+	}
+	if o.registered == nil {
+		o.registered = map[string]*api.Client{}
 	}
+	o.registered[name] = client
+}
+
+// registeredClient returns the client registered under the name in the
+// "client" parameter of u, and u with that parameter cleared. It returns a
+// nil client if u has no such parameter.
+func (o *lazyDialer) registeredClient(u *url.URL) (*api.Client, *url.URL, error) {
+	q := u.Query()
+	name := q.Get("client")
+	if name == "" {
+		return nil, u, nil
+	}
+	o.mu.Lock()
+	client := o.registered[name]
+	o.mu.Unlock()
+	if client == nil {
+		return nil, nil, fmt.Errorf("open keeper %q: no client registered under the name %q", u, name)
+	}
+	q.Del("client")
+	u2 := *u
+	u2.RawQuery = q.Encode()
+	return client, &u2, nil
+}
+
+// cacheEntry is a client cached by lazyDialer.
+type cacheEntry struct {
+	key    string
+	client *api.Client
+	hc     *http.Client
+	dialed time.Time
+}
+
+// expired reports whether the entry is older than ttl at the time now.
+func (e *cacheEntry) expired(now time.Time, ttl time.Duration) bool {
+	return ttl > 0 && now.Sub(e.dialed) >= ttl
+}
+
+func (o *lazyDialer) cachedClient(ctx context.Context, u *url.URL) (*api.Client, *url.URL, error) {
 	var cfg Config
 	var cacheKeyParts []string
 	q := u.Query()
@@ -97,7 +409,25 @@ func (o *lazyDialer) cachedClient(ctx context.Context, u *url.URL) (*api.Client,
 		case "token":
 			cfg.Token = value
 		case "address":
-			cfg.APIConfig.Address = value
+			if addrs := strings.Split(value, ","); len(addrs) > 1 {
+				cfg.Addresses = addrs
+			} else {
+				cfg.APIConfig.Address = value
+			}
+		case "header":
+			for _, v := range values {
+				parts := strings.SplitN(v, ":", 2)
+				if len(parts) != 2 {
+					return nil, nil, fmt.Errorf("open keeper %q: invalid header %q, want Name:Value", u, v)
+				}
+				if cfg.Headers == nil {
+					cfg.Headers = map[string]string{}
+				}
+				cfg.Headers[parts[0]] = parts[1]
+				cacheKeyParts = append(cacheKeyParts, fmt.Sprintf("%s=%s", param, v))
+			}
+			q.Del(param)
+			continue
 		default:
 			continue
 		}
@@ -106,14 +436,9 @@ func (o *lazyDialer) cachedClient(ctx context.Context, u *url.URL) (*api.Client,
 	}
 	sort.Strings(cacheKeyParts)
 	cacheKey := strings.Join(cacheKeyParts, ",")
-	client := o.clients[cacheKey]
-	if client == nil {
-		var err error
-		client, err = Dial(ctx, &cfg)
-		if err != nil {
-			return nil, nil, err
-		}
-		o.clients[cacheKey] = client
+	client, err := o.client(ctx, cacheKey, &cfg)
+	if err != nil {
+		return nil, nil, err
 	}
 	// Returned an updated URL with the query parameters that we used cleared.
 	u2 := u
@@ -121,11 +446,121 @@ func (o *lazyDialer) cachedClient(ctx context.Context, u *url.URL) (*api.Client,
 	return client, u2, nil
 }
 
+// dialTimeout bounds the dials of lazyDialer. A dial is shared by concurrent
+// callers, so it doesn't use the context of any of them.
+const dialTimeout = time.Minute
+
+// client returns the cached client for cacheKey, dialing it with cfg if it is
+// not cached. Concurrent calls for the same cacheKey share a single dial; a
+// caller whose ctx is done stops waiting for it, without failing the others.
+func (o *lazyDialer) client(ctx context.Context, cacheKey string, cfg *Config) (*api.Client, error) {
+	if c := o.lookup(cacheKey); c != nil {
+		return c, nil
+	}
+	ch := o.group.DoChan(cacheKey, func() (interface{}, error) {
+		// Another caller may have finished dialing just before we got here.
+		if c := o.lookup(cacheKey); c != nil {
+			return c, nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+		c, hc, err := dial(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		o.add(cacheKey, c, hc)
+		return c, nil
+	})
+	select {
+	case r := <-ch:
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		return r.Val.(*api.Client), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// lookup returns the cached client for cacheKey, or nil if there is no client
+// or it has expired.
+func (o *lazyDialer) lookup(cacheKey string) *api.Client {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.init()
+	e, ok := o.clients[cacheKey]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*cacheEntry)
+	if entry.expired(o.now(), o.opts.ClientTTL) {
+		o.evict(e)
+		return nil
+	}
+	o.lru.MoveToFront(e)
+	return entry.client
+}
+
+// add caches client under cacheKey, evicting the least recently used clients
+// if the cache is full.
+func (o *lazyDialer) add(cacheKey string, client *api.Client, hc *http.Client) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.init()
+	o.clients[cacheKey] = o.lru.PushFront(&cacheEntry{
+		key:    cacheKey,
+		client: client,
+		hc:     hc,
+		dialed: o.now(),
+	})
+	for o.lru.Len() > o.opts.maxCachedClients() {
+		o.evict(o.lru.Back())
+	}
+}
+
+// init initializes the cache. o.mu must be held.
+func (o *lazyDialer) init() {
+	if o.clients == nil {
+		o.clients = map[string]*list.Element{}
+		o.lru = list.New()
+	}
+	if o.now == nil {
+		o.now = time.Now
+	}
+}
+
+// evict removes e from the cache and closes the idle connections of its
+// client. Connections in use by keepers still holding the client are not
+// affected.
+func (o *lazyDialer) evict(e *list.Element) {
+	entry := o.lru.Remove(e).(*cacheEntry)
+	delete(o.clients, entry.key)
+	if t, ok := entry.hc.Transport.(*transport); ok {
+		t.closeIdleConnections()
+	}
+}
+
+// close evicts all the cached clients.
+func (o *lazyDialer) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.init()
+	for o.lru.Len() > 0 {
+		o.evict(o.lru.Back())
+	}
+}
+
 func (o *lazyDialer) OpenKeeperURL(ctx context.Context, u *url.URL) (*secrets.Keeper, error) {
-	client, u2, err := o.cachedClient(ctx, u)
+	client, u2, err := o.registeredClient(u)
 	if err != nil {
 		return nil, err
 	}
+	if client == nil {
+		client, u2, err = o.cachedClient(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+	}
 	opener := &URLOpener{Client: client}
 	return opener.OpenKeeperURL(ctx, u2)
 }
@@ -154,58 +589,695 @@ func (o *URLOpener) OpenKeeperURL(ctx context.Context, u *url.URL) (*secrets.Kee
 // NewKeeper returns a *secrets.Keeper that uses the Transit Secrets Engine of
 // Vault by Hashicorp.
 // See the package documentation for an example.
+//
+// client is safe for concurrent use: keepers for several keys of the same
+// server should share a single client, as the keepers opened by URL for a
+// given server do, so that they share its connections and login.
 func NewKeeper(client *api.Client, keyID string, opts *KeeperOptions) *secrets.Keeper {
-	return secrets.NewKeeper(&keeper{
+	return secrets.NewKeeper(newKeeper(client, keyID, opts))
+}
+
+func newKeeper(client *api.Client, keyID string, opts *KeeperOptions) *keeper {
+	if opts == nil {
+		opts = &KeeperOptions{}
+	}
+	return &keeper{
 		keyID:  keyID,
 		client: client,
-	})
+		opts:   *opts,
+	}
 }
 
 type keeper struct {
 	// keyID is an encryption key ring name used by the Vault's transit API.
 	keyID  string
 	client *api.Client
+	opts   KeeperOptions
+
+	mu       sync.Mutex
+	keyReady bool // true once the key is known to exist
+	// adChecked is true once the support of associated data by the server
+	// is known; adErr is nil if it supports it.
+	adChecked bool
+	adErr     error
+}
+
+// createKeyIfNotExists creates the transit key with the configured type if it
+// does not exist yet.
+func (k *keeper) createKeyIfNotExists(ctx context.Context) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.keyReady {
+		return nil
+	}
+	keyPath := path.Join("transit/keys", k.keyID)
+	secret, err := read(ctx, k.client, keyPath)
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		data := map[string]interface{}{}
+		if k.opts.KeyType != "" {
+			data["type"] = k.opts.KeyType
+		}
+		if k.opts.Exportable {
+			data["exportable"] = true
+		}
+		if k.opts.Derived {
+			data["derived"] = true
+		}
+		if _, err := write(ctx, k.client, keyPath, data); err != nil {
+			return err
+		}
+		if k.opts.AllowDeletion {
+			// Vault only accepts deletion_allowed as a key configuration.
+			if _, err := write(ctx, k.client, path.Join(keyPath, "config"), map[string]interface{}{
+				"deletion_allowed": true,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	k.keyReady = true
+	return nil
 }
 
 // Decrypt decrypts the ciphertext into a plaintext.
-func (k *keeper) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
-	out, err := k.client.Logical().Write(
-		path.Join("transit/decrypt", k.keyID),
-		map[string]interface{}{
-			"ciphertext": string(ciphertext),
-		},
-	)
+func (k *keeper) Decrypt(ctx context.Context, ciphertext []byte) (_ []byte, err error) {
+	ctx, span := k.startSpan(ctx, "vault.Decrypt")
+	defer func() { endSpan(span, err) }()
+
+	keyID, ciphertext := splitKeyName(ciphertext)
+	if keyID == "" {
+		keyID = k.keyID
+	}
+	return k.decrypt(ctx, keyID, ciphertext)
+}
+
+// transitPrefix is the prefix of the ciphertexts of the Transit Secrets
+// Engine.
+const transitPrefix = "vault:"
+
+// splitKeyName splits a ciphertext returned by Encrypt into the name of the
+// transit key embedded in it, if KeeperOptions.EmbedKeyName was set, and the
+// ciphertext of the Transit Secrets Engine. keyName is empty if ciphertext
+// does not embed a key name.
+func splitKeyName(ciphertext []byte) (keyName string, transit []byte) {
+	if bytes.HasPrefix(ciphertext, []byte(transitPrefix)) {
+		return "", ciphertext
+	}
+	i := bytes.Index(ciphertext, []byte(":"+transitPrefix))
+	if i <= 0 {
+		return "", ciphertext
+	}
+	return string(ciphertext[:i]), ciphertext[i+1:]
+}
+
+// decrypt decrypts ciphertext with the transit key keyID, which need not be
+// the key of k.
+func (k *keeper) decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error) {
+	data := map[string]interface{}{
+		"ciphertext": string(ciphertext),
+	}
+	c := k.derivationContext(ctx)
+	if c != nil {
+		data["context"] = c
+	}
+	if ad := associatedData(ctx); ad != nil {
+		if err := k.checkAssociatedData(ctx); err != nil {
+			return nil, err
+		}
+		data["associated_data"] = ad
+	}
+	out, err := write(ctx, k.client, path.Join("transit/decrypt", keyID), data)
 	if err != nil {
+		if c != nil && isAuthFailure(err) {
+			// With a derived key, this is how Vault reports a ciphertext
+			// encrypted with another derivation context.
+			return nil, gcerr.Newf(gcerr.FailedPrecondition, err, "vault: cannot decrypt with transit key %q: the ciphertext was encrypted with another derivation context, or is corrupt", keyID)
+		}
 		return nil, err
 	}
-	return base64.StdEncoding.DecodeString(out.Data["plaintext"].(string))
+	if out == nil {
+		return nil, gcerr.Newf(gcerr.NotFound, nil, "vault: transit key %q not found", keyID)
+	}
+	// Vault omits the plaintext when it is empty.
+	plaintext, _ := out.Data["plaintext"].(string)
+	return base64.StdEncoding.DecodeString(plaintext)
 }
 
 // Encrypt encrypts a plaintext into a ciphertext.
-func (k *keeper) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
-	secret, err := k.client.Logical().Write(
-		path.Join("transit/encrypt", k.keyID),
-		map[string]interface{}{
-			"plaintext": plaintext,
-		},
-	)
+func (k *keeper) Encrypt(ctx context.Context, plaintext []byte) (_ []byte, err error) {
+	ctx, span := k.startSpan(ctx, "vault.Encrypt")
+	defer func() { endSpan(span, err) }()
+
+	if k.opts.CreateKeyIfNotExists {
+		if err := k.createKeyIfNotExists(ctx); err != nil {
+			return nil, err
+		}
+	}
+	secret, err := k.encrypt(ctx, plaintext)
+	if err == nil && secret == nil && k.opts.CreateKeyIfNotExists {
+		// Vault responded with a 404; the key was removed after we last
+		// checked for it, so create it again and retry once.
+		k.mu.Lock()
+		k.keyReady = false
+		k.mu.Unlock()
+		if err := k.createKeyIfNotExists(ctx); err != nil {
+			return nil, err
+		}
+		secret, err = k.encrypt(ctx, plaintext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, gcerr.Newf(gcerr.NotFound, nil, "vault: transit key %q not found", k.keyID)
+	}
+	ciphertext, _ := secret.Data["ciphertext"].(string)
+	if ciphertext == "" {
+		return nil, errors.New("vault: encrypt response has no ciphertext")
+	}
+	return []byte(k.embedKeyName(ciphertext)), nil
+}
+
+// embedKeyName prefixes ciphertext with the name of the key of k if
+// KeeperOptions.EmbedKeyName is set.
+func (k *keeper) embedKeyName(ciphertext string) string {
+	if !k.opts.EmbedKeyName {
+		return ciphertext
+	}
+	return k.keyID + ":" + ciphertext
+}
+
+// startSpan starts the span of the operation name on the key. The Vault
+// requests made with the returned context carry its trace context in the
+// traceparent header, so that they can be correlated with Vault audit logs.
+func (k *keeper) startSpan(ctx context.Context, name string) (context.Context, *trace.Span) {
+	ctx, span := trace.StartSpan(ctx, name)
+	span.AddAttributes(trace.StringAttribute("key_id", k.keyID))
+	return ctx, span
+}
+
+// endSpan ends span, recording the code of err in its status.
+func endSpan(span *trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(trace.Status{Code: int32(errorCode(err)), Message: err.Error()})
+	}
+	span.End()
+}
+
+func (k *keeper) encrypt(ctx context.Context, plaintext []byte) (*api.Secret, error) {
+	if plaintext == nil {
+		// A nil slice would be sent as null rather than as an empty
+		// plaintext.
+		plaintext = []byte{}
+	}
+	data := map[string]interface{}{
+		"plaintext": plaintext,
+	}
+	if c := k.derivationContext(ctx); c != nil {
+		data["context"] = c
+	}
+	if ad := associatedData(ctx); ad != nil {
+		if err := k.checkAssociatedData(ctx); err != nil {
+			return nil, err
+		}
+		data["associated_data"] = ad
+	}
+	if k.opts.Nonce != nil {
+		if len(k.opts.Nonce) != nonceSize {
+			return nil, fmt.Errorf("vault: invalid nonce of %d bytes, want %d", len(k.opts.Nonce), nonceSize)
+		}
+		data["nonce"] = k.opts.Nonce
+	}
+	if v := k.encryptKeyVersion(ctx); v > 0 {
+		data["key_version"] = v
+	}
+	return write(ctx, k.client, path.Join("transit/encrypt", k.keyID), data)
+}
+
+// nonceSize is the size of the nonces used by the transit key types that
+// support convergent encryption.
+const nonceSize = 12
+
+// read makes a GET request to the Vault API at path.
+func read(ctx context.Context, client *api.Client, path string) (*api.Secret, error) {
+	return request(ctx, client, http.MethodGet, path, nil, 0)
+}
+
+// write makes a PUT request to the Vault API at path, with data as the JSON
+// request body.
+func write(ctx context.Context, client *api.Client, path string, data map[string]interface{}) (*api.Secret, error) {
+	return request(ctx, client, http.MethodPut, path, data, 0)
+}
+
+// request makes a request to the Vault API that is bounded by ctx, unlike the
+// methods of api.Logical. Like them, it returns a nil *api.Secret and a nil
+// error if Vault responds with 404. If wrapTTL is positive, Vault wraps the
+// response in a token valid for wrapTTL, returned in the WrapInfo of the
+// *api.Secret.
+func request(ctx context.Context, client *api.Client, method, path string, data map[string]interface{}, wrapTTL time.Duration) (*api.Secret, error) {
+	return requestWithParams(ctx, client, method, path, nil, data, wrapTTL)
+}
+
+// requestWithParams is like request, with params as the query parameters of
+// the request.
+func requestWithParams(ctx context.Context, client *api.Client, method, path string, params url.Values, data map[string]interface{}, wrapTTL time.Duration) (*api.Secret, error) {
+	r := client.NewRequest(method, "/v1/"+path)
+	for k, v := range params {
+		r.Params[k] = v
+	}
+	if wrapTTL > 0 {
+		r.WrapTTL = wrapTTL.String()
+	}
+	if mfa, ok := ctx.Value(mfaKey{}).(string); ok {
+		r.MFAHeaderVals = []string{mfa}
+	}
+	if token, ok := ctx.Value(tokenKey{}).(string); ok {
+		r.ClientToken = token
+	}
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		// r.Headers is shared with the client, so that setting it would make
+		// every later request carry id.
+		h := make(http.Header, len(r.Headers)+1)
+		for k, v := range r.Headers {
+			h[k] = v
+		}
+		h.Set(RequestIDHeader, id)
+		r.Headers = h
+	}
+	if data != nil {
+		if err := r.SetJSONBody(data); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := client.RawRequestWithContext(ctx, r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		if resp != nil {
+			return nil, newResponseError(method, path, resp)
+		}
 		return nil, err
 	}
-	return []byte(secret.Data["ciphertext"].(string)), nil
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return nil, nil
+	case resp.StatusCode >= 400:
+		// The Vault client does not treat 429 as an error, as it is also used
+		// by standby nodes for health checks.
+		return nil, newResponseError(method, path, resp)
+	}
+	return api.ParseSecret(resp.Body)
+}
+
+// mfaKey is the context key of the MFA credentials set by WithMFA.
+type mfaKey struct{}
+
+// tokenKey is the context key of a token that authenticates a request instead
+// of the token of the client, such as a wrapping token.
+type tokenKey struct{}
+
+// WithMFA returns a copy of ctx that makes the Vault requests of operations
+// using it, such as Encrypt and Decrypt, carry the given MFA credentials. Use
+// it for paths that are protected by a Vault MFA method, such as a TOTP
+// method. When credentials are missing or invalid for such a path, operations
+// fail with an error whose code is FailedPrecondition.
+func WithMFA(ctx context.Context, method, passcode string) context.Context {
+	return context.WithValue(ctx, mfaKey{}, method+":"+passcode)
+}
+
+// requestIDKey is the context key of the request ID set by WithRequestID.
+type requestIDKey struct{}
+
+// RequestIDHeader is the header of the Vault requests carrying the request ID
+// set by WithRequestID.
+const RequestIDHeader = "X-Request-Id"
+
+// WithRequestID returns a copy of ctx that makes the Vault requests of
+// operations using it, such as Encrypt and Decrypt, carry id in their
+// RequestIDHeader header, for example to correlate them with the application
+// request they were made for. Vault records the header in its audit log once
+// it is enabled with sys/config/auditing/request-headers/X-Request-Id. Other
+// operations of the client are not affected.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// derivationContextKey is the context key of the key derivation context set
+// by WithDerivationContext.
+type derivationContextKey struct{}
+
+// WithDerivationContext returns a copy of ctx that makes the operations using
+// it, such as Encrypt and Decrypt, use c as the key derivation context instead
+// of KeeperOptions.Context. With a key created with key derivation enabled,
+// this binds a ciphertext to c: decrypting it with a different c fails. Use it,
+// for example, to bind data to the tenant that owns it.
+func WithDerivationContext(ctx context.Context, c []byte) context.Context {
+	return context.WithValue(ctx, derivationContextKey{}, c)
+}
+
+// derivationContext returns the key derivation context of operations using
+// ctx, or nil if there is none.
+func (k *keeper) derivationContext(ctx context.Context) []byte {
+	if c, ok := ctx.Value(derivationContextKey{}).([]byte); ok {
+		return c
+	}
+	if f := k.opts.ContextFromRequest; f != nil {
+		if c := f(ctx); c != nil {
+			return c
+		}
+	}
+	return k.opts.Context
+}
+
+// associatedDataKey is the context key of the associated data set by
+// WithAssociatedData.
+type associatedDataKey struct{}
+
+// WithAssociatedData returns a copy of ctx that makes the Encrypt and Decrypt
+// operations using it, and those of Key.BatchEncrypt and Key.BatchDecrypt,
+// send ad as the associated data of AES-GCM keys. This binds a ciphertext to
+// non-secret data, such as the ID of the record it is stored in: decrypting
+// it with different associated data fails. Associated data requires Vault
+// 1.13 or later. Older servers would silently ignore it, leaving the
+// ciphertext unbound, so operations with associated data fail with an error
+// whose code is FailedPrecondition on them.
+func WithAssociatedData(ctx context.Context, ad []byte) context.Context {
+	return context.WithValue(ctx, associatedDataKey{}, ad)
+}
+
+// associatedData returns the associated data of operations using ctx, or nil
+// if there is none.
+func associatedData(ctx context.Context) []byte {
+	ad, _ := ctx.Value(associatedDataKey{}).([]byte)
+	return ad
+}
+
+// checkAssociatedData returns an error whose code is FailedPrecondition if
+// ctx has associated data and the Vault server of k is too old to support it.
+// The version of the server is read once per keeper.
+func (k *keeper) checkAssociatedData(ctx context.Context) error {
+	if associatedData(ctx) == nil {
+		return nil
+	}
+	k.mu.Lock()
+	checked, err := k.adChecked, k.adErr
+	k.mu.Unlock()
+	if checked {
+		return err
+	}
+	v, err := serverVersion(ctx, k.client)
+	if err != nil {
+		return err
+	}
+	if !versionAtLeast(v, 1, 13) {
+		err = gcerr.Newf(gcerr.FailedPrecondition, nil, "vault: associated data requires Vault 1.13 or later, the server runs %s", v)
+	}
+	k.mu.Lock()
+	k.adChecked, k.adErr = true, err
+	k.mu.Unlock()
+	return err
+}
+
+// serverVersion returns the version of the Vault server used by client, such
+// as "1.13.2", whatever the state of the server.
+func serverVersion(ctx context.Context, client *api.Client) (string, error) {
+	h, err := health(ctx, client)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", ctxErr
+		}
+		return "", fmt.Errorf("vault: reading the server version: %v", err)
+	}
+	return h.Version, nil
+}
+
+// versionAtLeast reports whether the Vault version v, such as "1.13.2+ent",
+// is major.minor or later.
+func versionAtLeast(v string, major, minor int) bool {
+	var maj, min int
+	if _, err := fmt.Sscanf(v, "%d.%d", &maj, &min); err != nil {
+		return false
+	}
+	return maj > major || maj == major && min >= minor
+}
+
+// encryptKeyVersionKey is the context key of the key version set by
+// WithEncryptKeyVersion.
+type encryptKeyVersionKey struct{}
+
+// WithEncryptKeyVersion returns a copy of ctx that makes the encryptions
+// using it, such as Encrypt and Key.BatchEncrypt, use version v of the key
+// instead of KeeperOptions.EncryptKeyVersion. A v of 0 uses the latest
+// version.
+func WithEncryptKeyVersion(ctx context.Context, v int) context.Context {
+	return context.WithValue(ctx, encryptKeyVersionKey{}, v)
+}
+
+// encryptKeyVersion returns the version of the key used by encryptions using
+// ctx, or 0 for the latest version.
+func (k *keeper) encryptKeyVersion(ctx context.Context) int {
+	if v, ok := ctx.Value(encryptKeyVersionKey{}).(int); ok {
+		return v
+	}
+	return k.opts.EncryptKeyVersion
+}
+
+// ResponseError is returned when Vault responds to a request with an error
+// status.
+type ResponseError struct {
+	// Method and Path are the HTTP method and the Vault API path of the
+	// request, such as "transit/decrypt/mykey".
+	Method, Path string
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Errors are the error messages returned by Vault.
+	Errors []string
+}
+
+func (e *ResponseError) Error() string {
+	msg := fmt.Sprintf("vault: %s %s: response status %d", e.Method, e.Path, e.StatusCode)
+	if len(e.Errors) > 0 {
+		msg += ": " + strings.Join(e.Errors, "; ")
+	}
+	return msg
+}
+
+// mfaFailed reports whether Vault rejected the request because MFA
+// credentials were missing or invalid.
+func (e *ResponseError) mfaFailed() bool {
+	for _, msg := range e.Errors {
+		if strings.Contains(strings.ToLower(msg), "mfa") {
+			return true
+		}
+	}
+	return false
+}
+
+// newResponseError returns the *ResponseError for resp.
+func newResponseError(method, path string, resp *api.Response) *ResponseError {
+	e := &ResponseError{Method: method, Path: path, StatusCode: resp.StatusCode}
+	var body api.ErrorResponse
+	// A body that is not the JSON error format of Vault leaves Errors empty.
+	if err := resp.DecodeJSON(&body); err == nil {
+		e.Errors = body.Errors
+	}
+	return e
+}
+
+// As implements driver.Keeper.As.
+func (k *keeper) As(i interface{}) bool {
+	c, ok := i.(**api.Client)
+	if !ok {
+		return false
+	}
+	*c = k.client
+	return true
 }
 
 // ErrorAs implements driver.Keeper.ErrorAs.
 func (k *keeper) ErrorAs(err error, i interface{}) bool {
+	switch e := err.(type) {
+	case *ResponseError:
+		p, ok := i.(**ResponseError)
+		if !ok {
+			return false
+		}
+		*p = e
+		return true
+	case *BatchError:
+		p, ok := i.(**BatchError)
+		if !ok {
+			return false
+		}
+		*p = e
+		return true
+	}
 	return false
 }
 
+// errVersionTooOld is part of the error message of Vault when a ciphertext is
+// older than the key's minimum decryption version.
+const errVersionTooOld = "disallowed by policy (too old)"
+
+// errNotExportable is part of the error message of Vault when exporting a key
+// that was not created as exportable.
+const errNotExportable = "not exportable"
+
+// errAuthFailed is part of the error message of Vault when a ciphertext
+// fails authentication, which happens when it was encrypted with another
+// derivation context.
+const errAuthFailed = "message authentication failed"
+
+// errMissingContext is part of the error message of Vault when an operation
+// on a key created with key derivation enabled has no derivation context.
+const errMissingContext = "missing 'context' for key derivation"
+
+// isAuthFailure reports whether err is the response of Vault to a ciphertext
+// that fails authentication.
+func isAuthFailure(err error) bool {
+	e, ok := err.(*ResponseError)
+	return ok && e.StatusCode == http.StatusBadRequest && strings.Contains(e.Error(), errAuthFailed)
+}
+
+// errSealed is part of the error message of Vault when it is sealed. Requests
+// to a sealed server fail with an error whose code is FailedPrecondition, as
+// the server must be unsealed before they can succeed.
+const errSealed = "Vault is sealed"
+
+// errUnsupportedKeyType is part of the error message of Vault when an
+// operation is not supported by the type of the key, such as encrypting with a
+// signing key.
+const errUnsupportedKeyType = "not supported for key type"
+
 // ErrorCode implements driver.ErrorCode.
-func (k *keeper) ErrorCode(error) gcerrors.ErrorCode {
-	// TODO(shantuo): try to classify vault error codes
+func (k *keeper) ErrorCode(err error) gcerrors.ErrorCode {
+	return errorCode(err)
+}
+
+// errorCode returns the code to use for an error returned while talking to
+// Vault.
+func errorCode(err error) gcerrors.ErrorCode {
+	if e, ok := err.(*gcerr.Error); ok {
+		return e.Code
+	}
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	switch err.(type) {
+	case *retriesExhaustedError:
+		return gcerrors.Unavailable
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, errVersionTooOld), strings.Contains(msg, errUnsupportedKeyType), strings.Contains(msg, errMissingContext),
+		strings.Contains(msg, errSealed):
+		return gcerrors.FailedPrecondition
+	case strings.Contains(msg, errNotExportable):
+		return gcerrors.PermissionDenied
+	}
+	if e, ok := err.(*ResponseError); ok {
+		if e.StatusCode == http.StatusForbidden && e.mfaFailed() {
+			return gcerrors.FailedPrecondition
+		}
+		return statusCode(e.StatusCode)
+	}
+	return gcerrors.Unknown
+}
+
+// statusCode returns the code for an error response of Vault with the given
+// HTTP status code.
+func statusCode(code int) gcerrors.ErrorCode {
+	switch code {
+	case http.StatusBadRequest:
+		return gcerrors.InvalidArgument
+	case http.StatusForbidden:
+		return gcerrors.PermissionDenied
+	case http.StatusNotFound:
+		return gcerrors.NotFound
+	case http.StatusPreconditionFailed:
+		return gcerrors.FailedPrecondition
+	case http.StatusTooManyRequests:
+		return gcerrors.ResourceExhausted
+	case http.StatusInternalServerError, http.StatusBadGateway:
+		return gcerrors.Internal
+	case http.StatusServiceUnavailable:
+		return gcerrors.Unavailable
+	}
 	return gcerrors.Unknown
 }
 
 // KeeperOptions controls Keeper behaviors.
-// It is provided for future extensibility.
-type KeeperOptions struct{}
+type KeeperOptions struct {
+	// DataKeyBits is the size of the data keys generated by Key.GenerateDataKey,
+	// in bits. Valid values are 128, 256 and 512. Defaults to 256.
+	DataKeyBits int
+
+	// CreateKeyIfNotExists makes the keeper create the transit key before the
+	// first Encrypt if it does not exist yet.
+	CreateKeyIfNotExists bool
+
+	// KeyType is the type of the key created when CreateKeyIfNotExists is set:
+	// "aes256-gcm96", "chacha20-poly1305", "ed25519", "ecdsa-p256",
+	// "rsa-2048" or "rsa-4096". Defaults to Vault's default key type,
+	// "aes256-gcm96". Operations that the key type does not support, such as
+	// encrypting with an "ed25519" key, fail with an error whose code is
+	// FailedPrecondition.
+	KeyType string
+
+	// Exportable, AllowDeletion and Derived configure the key created when
+	// CreateKeyIfNotExists is set. Exportable allows exporting the key with
+	// Key.ExportKey, AllowDeletion allows deleting it and Derived enables key
+	// derivation, which requires setting Context.
+	Exportable    bool
+	AllowDeletion bool
+	Derived       bool
+
+	// Context is the key derivation context sent with every Encrypt and
+	// Decrypt. It is required for keys created with key derivation enabled.
+	// It can be overridden for a single operation with WithDerivationContext.
+	Context []byte
+
+	// ContextFromRequest, if set, returns the key derivation context of an
+	// operation from its context.Context, for example from a tenant ID set by
+	// the application, so that encryption is scoped to the tenant without
+	// passing it to every call. A nil result falls back to Context.
+	// WithDerivationContext takes precedence over it.
+	ContextFromRequest func(ctx context.Context) []byte
+
+	// Nonce is the 96-bit nonce sent with every Encrypt. It is only used for
+	// keys created with convergent encryption enabled, for which encrypting
+	// the same plaintext with the same Context and Nonce always produces the
+	// same ciphertext. Decrypt does not need it.
+	Nonce []byte
+
+	// WrapTTL is how long the wrapping tokens returned by Key.WrapDataKey and
+	// Key.WrapExportKey are valid for. It must be set to use them.
+	WrapTTL time.Duration
+
+	// EmbedKeyName makes Encrypt prefix the ciphertexts it returns with the
+	// name of the transit key, as "<keyname>:vault:v1:...". Decrypt always
+	// decrypts such ciphertexts with the key they name, whatever the key of
+	// the keeper, so that data keeps decrypting after the application moves
+	// to a new key. Ciphertexts without the prefix are decrypted with the key
+	// of the keeper. Key.BatchEncrypt and Key.BatchRewrap add the prefix too,
+	// and Key.BatchDecrypt and Key.BatchRewrap reject ciphertexts naming
+	// another key.
+	EmbedKeyName bool
+
+	// EncryptKeyVersion, if positive, is the version of the key used by
+	// Encrypt, instead of the latest version, for example to roll out a new
+	// version gradually. It can be overridden for a single operation with
+	// WithEncryptKeyVersion. Encrypting with a version newer than the latest
+	// fails with an error whose code is InvalidArgument.
+	EncryptKeyVersion int
+}
@@ -15,16 +15,49 @@
 package vault
 
 import (
+	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"path"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	kv "github.com/hashicorp/vault-plugin-secrets-kv"
 	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/builtin/credential/approle"
+	"github.com/hashicorp/vault/builtin/credential/userpass"
 	"github.com/hashicorp/vault/builtin/logical/transit"
 	vhttp "github.com/hashicorp/vault/http"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/vault"
+	"go.opencensus.io/trace"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/testing/octest"
 	"gocloud.dev/secrets"
 	"gocloud.dev/secrets/driver"
 	"gocloud.dev/secrets/drivertest"
@@ -50,27 +83,37 @@ func (h *harness) Close() {
 }
 
 func newHarness(ctx context.Context, t *testing.T) (drivertest.Harness, error) {
-	// Start a new test server.
+	c, cleanup := testTransitServer(t)
+	return &harness{
+		client: c,
+		close:  cleanup,
+	}, nil
+}
+
+// testTransitServer starts a new test server with the Transit Secrets Engine
+// enabled.
+func testTransitServer(t testing.TB) (*api.Client, func()) {
 	c, cleanup := testVaultServer(t)
 	// Enable the Transit Secrets Engine to use Vault as an Encryption as a Service.
 	c.Logical().Write("sys/mounts/transit", map[string]interface{}{
 		"type": "transit",
 	})
-
-	return &harness{
-		client: c,
-		close:  cleanup,
-	}, nil
+	return c, cleanup
 }
 
-func testVaultServer(t *testing.T) (*api.Client, func()) {
+func testVaultServer(t testing.TB) (*api.Client, func()) {
 	coreCfg := &vault.CoreConfig{
 		DisableMlock: true,
 		DisableCache: true,
 		// Enable the testing transit backend.
 		LogicalBackends: map[string]logical.Factory{
+			"kv":      kv.Factory,
 			"transit": transit.Factory,
 		},
+		CredentialBackends: map[string]logical.Factory{
+			"approle":  approle.Factory,
+			"userpass": userpass.Factory,
+		},
 	}
 	cluster := vault.NewTestCluster(t, coreCfg, &vault.TestClusterOptions{
 		HandlerFunc: vhttp.Handler,
@@ -79,54 +122,2249 @@ func testVaultServer(t *testing.T) (*api.Client, func()) {
 	tc := cluster.Cores[0]
 	vault.TestWaitActive(t, tc.Core)
 
-	tc.Client.SetToken(cluster.RootToken)
-	return tc.Client, cluster.Cleanup
-}
+	tc.Client.SetToken(cluster.RootToken)
+	return tc.Client, cluster.Cleanup
+}
+
+func TestConformance(t *testing.T) {
+	drivertest.RunConformanceTests(t, newHarness, []drivertest.AsTest{verifyAs{}})
+}
+
+type verifyAs struct{}
+
+func (v verifyAs) Name() string {
+	return "verify As function"
+}
+
+func (v verifyAs) ErrorCheck(k *secrets.Keeper, err error) error {
+	var s string
+	if k.ErrorAs(err, &s) {
+		return errors.New("Keeper.ErrorAs expected to fail")
+	}
+	return nil
+}
+
+// Vault-specific tests.
+
+func TestNoSessionProvidedError(t *testing.T) {
+	if _, err := Dial(context.Background(), nil); err == nil {
+		t.Error("got nil, want no auth Config provided")
+	}
+}
+
+func TestNoConnectionError(t *testing.T) {
+	ctx := context.Background()
+
+	// Dial calls vault's NewClient method, which doesn't make the connection. Try
+	// doing encryption which should fail by no connection.
+	client, err := Dial(ctx, &Config{
+		Token: "<Client (Root) Token>",
+		APIConfig: api.Config{
+			Address: apiAddress,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keeper := NewKeeper(client, "my-key", nil)
+	if _, err := keeper.Encrypt(ctx, []byte("test")); err == nil {
+		t.Error("got nil, want connection refused")
+	}
+}
+
+func TestGenerateDataKey(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, nil); err != nil {
+		t.Fatal(err)
+	}
+	key := NewKey(c, keyID1, &KeeperOptions{DataKeyBits: 256})
+	dataKey, wrapped, err := key.GenerateDataKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(dataKey), 32; got != want {
+		t.Fatalf("got data key of %d bytes, want %d", got, want)
+	}
+
+	// Encrypt a payload locally with the data key.
+	payload := []byte("a large object")
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		t.Fatal(err)
+	}
+	sealed := gcm.Seal(nil, nonce, payload, nil)
+
+	// Unwrap the data key with Vault and decrypt the payload.
+	unwrapped, err := key.Keeper().Decrypt(ctx, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, dataKey) {
+		t.Fatal("unwrapped data key does not match the generated one")
+	}
+	block, err = aes.NewCipher(unwrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err = cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, payload) {
+		t.Errorf("got %q, want %q", opened, payload)
+	}
+}
+
+func TestGenerateDataKeyInvalidBits(t *testing.T) {
+	key := NewKey(nil, keyID1, &KeeperOptions{DataKeyBits: 100})
+	if _, _, err := key.GenerateDataKey(context.Background()); err == nil {
+		t.Error("got nil, want invalid data key size error")
+	}
+}
+
+func TestGenerateDataKeyNotFound(t *testing.T) {
+	ctx := context.Background()
+	srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/transit/datakey/plaintext/missing":
+			writeError(w, http.StatusNotFound)
+		default:
+			// A response without the data key.
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"data":{}}`)
+		}
+	})
+	defer srv.Close()
+	client := dialStub(t, srv, nil)
+
+	key := NewKey(client, "missing", nil)
+	if _, _, err := key.GenerateDataKey(ctx); gcerrors.Code(err) != gcerrors.NotFound {
+		t.Errorf("GenerateDataKey: got error %v, want code %v", err, gcerrors.NotFound)
+	}
+	if err := key.EncryptLarge(ctx, strings.NewReader("payload"), ioutil.Discard); gcerrors.Code(err) != gcerrors.NotFound {
+		t.Errorf("EncryptLarge: got error %v, want code %v", err, gcerrors.NotFound)
+	}
+	if _, _, err := NewKey(client, "empty", nil).GenerateDataKey(ctx); err == nil {
+		t.Error("got nil, want error for a response without the data key")
+	}
+}
+
+func TestGenerateWrappedDataKey(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, nil); err != nil {
+		t.Fatal(err)
+	}
+	key := NewKey(c, keyID1, &KeeperOptions{DataKeyBits: 128})
+	ciphertext, err := key.GenerateWrappedDataKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, err := key.Keeper().Decrypt(ctx, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(dataKey), 16; got != want {
+		t.Errorf("got data key of %d bytes, want %d", got, want)
+	}
+}
+
+func TestCreateKeyIfNotExists(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	keeper := NewKeeper(c, keyID1, &KeeperOptions{
+		CreateKeyIfNotExists: true,
+		KeyType:              "chacha20-poly1305",
+	})
+	ciphertext, err := keeper.Encrypt(ctx, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keeper.Decrypt(ctx, ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := c.Logical().Read("transit/keys/" + keyID1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret == nil {
+		t.Fatal("key was not created")
+	}
+	if got, want := secret.Data["type"], "chacha20-poly1305"; got != want {
+		t.Errorf("got key type %v, want %v", got, want)
+	}
+}
+
+func TestCreateKeyProperties(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	keeper := NewKeeper(c, keyID1, &KeeperOptions{
+		CreateKeyIfNotExists: true,
+		KeyType:              "ed25519",
+		Exportable:           true,
+		AllowDeletion:        true,
+	})
+	_, err := keeper.Encrypt(ctx, []byte("test"))
+	if got, want := gcerrors.Code(err), gcerrors.FailedPrecondition; got != want {
+		t.Errorf("got error code %v, want %v (err: %v)", got, want, err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "ed25519") {
+		t.Errorf("got error %q, want it to mention the key type", err)
+	}
+	secret, err := c.Logical().Read("transit/keys/" + keyID1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret == nil {
+		t.Fatal("key was not created")
+	}
+	for field, want := range map[string]interface{}{
+		"type":             "ed25519",
+		"exportable":       true,
+		"deletion_allowed": true,
+		"supports_signing": true,
+	} {
+		if got := secret.Data[field]; got != want {
+			t.Errorf("got %s %v, want %v", field, got, want)
+		}
+	}
+}
+
+// stubServer starts an HTTP server that replies to the i-th request (starting
+// at 0) using handler, and counts the requests it receives.
+func stubServer(handler func(i int, w http.ResponseWriter, r *http.Request)) (*httptest.Server, *int32) {
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(int(atomic.AddInt32(&n, 1)-1), w, r)
+	}))
+	return srv, &n
+}
+
+func writeCiphertext(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, `{"data":{"ciphertext":"vault:v1:Y2lwaGVydGV4dA=="}}`)
+}
+
+func writeError(w http.ResponseWriter, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	io.WriteString(w, `{"errors":["stub error"]}`)
+}
+
+func dialStub(t *testing.T, srv *httptest.Server, policy *RetryPolicy) *api.Client {
+	client, err := Dial(context.Background(), &Config{
+		Token:       "<Client (Root) Token>",
+		APIConfig:   api.Config{Address: srv.URL},
+		RetryPolicy: policy,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	srv, n := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		if i < 2 {
+			writeError(w, http.StatusServiceUnavailable)
+			return
+		}
+		writeCiphertext(w)
+	})
+	defer srv.Close()
+
+	client := dialStub(t, srv, &RetryPolicy{MaxAttempts: 5, BaseBackoff: time.Millisecond})
+	keeper := NewKeeper(client, keyID1, nil)
+	if _, err := keeper.Encrypt(context.Background(), []byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := atomic.LoadInt32(n), int32(3); got != want {
+		t.Errorf("got %d requests, want %d", got, want)
+	}
+}
+
+// testLogger is a Logger that records the messages it receives.
+type testLogger struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(&l.buf, format+"\n", v...)
+}
+
+func (l *testLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+func TestLogRetries(t *testing.T) {
+	srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		if i < 1 {
+			writeError(w, http.StatusServiceUnavailable)
+			return
+		}
+		writeCiphertext(w)
+	})
+	defer srv.Close()
+
+	const token = "s.secret-token"
+	logger := &testLogger{}
+	u, _ := url.Parse(srv.URL)
+	u.User = url.UserPassword("proxy", "proxy-password")
+	client, err := Dial(context.Background(), &Config{
+		Token:       token,
+		APIConfig:   api.Config{Address: u.String()},
+		RetryPolicy: &RetryPolicy{MaxAttempts: 5, BaseBackoff: time.Millisecond},
+		Logger:      logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKeeper(client, keyID1, nil).Encrypt(context.Background(), []byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	got := logger.String()
+	if !strings.Contains(got, "503") || !strings.Contains(got, "attempt 1 of 5") {
+		t.Errorf("got log %q, want the retried 503 logged", got)
+	}
+	for _, secret := range []string{token, "proxy-password"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("got log %q, want %q redacted", got, secret)
+		}
+	}
+}
+
+func TestDialTwice(t *testing.T) {
+	srv, n := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		if i%2 == 0 {
+			writeError(w, http.StatusServiceUnavailable)
+			return
+		}
+		writeCiphertext(w)
+	})
+	defer srv.Close()
+
+	var observed int32
+	hc := &http.Client{}
+	cfg := &Config{
+		Token:       "<Client (Root) Token>",
+		APIConfig:   api.Config{HttpClient: hc},
+		Addresses:   []string{srv.URL},
+		RetryPolicy: &RetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond},
+		RequestObserver: func(string, time.Duration, error) {
+			atomic.AddInt32(&observed, 1)
+		},
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		client, err := Dial(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		atomic.StoreInt32(n, 0)
+		atomic.StoreInt32(&observed, 0)
+		if _, err := NewKeeper(client, keyID1, nil).Encrypt(ctx, []byte("test")); err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		if got := atomic.LoadInt32(n); got != 2 {
+			t.Errorf("dial %d: got %d attempts, want 2", i, got)
+		}
+		if got := atomic.LoadInt32(&observed); got != 1 {
+			t.Errorf("dial %d: got %d observed requests, want 1", i, got)
+		}
+	}
+	if cfg.APIConfig.Address != "" {
+		t.Errorf("got Config.APIConfig.Address %q after Dial, want it unchanged", cfg.APIConfig.Address)
+	}
+	if cfg.APIConfig.HttpClient != hc || hc.Transport != nil {
+		t.Error("got Config.APIConfig.HttpClient modified by Dial")
+	}
+}
+
+func TestRetryNotOnPermissionDenied(t *testing.T) {
+	srv, n := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusForbidden)
+	})
+	defer srv.Close()
+
+	client := dialStub(t, srv, &RetryPolicy{MaxAttempts: 5, BaseBackoff: time.Millisecond})
+	keeper := NewKeeper(client, keyID1, nil)
+	if _, err := keeper.Encrypt(context.Background(), []byte("test")); err == nil {
+		t.Fatal("got nil, want permission denied error")
+	}
+	if got, want := atomic.LoadInt32(n), int32(1); got != want {
+		t.Errorf("got %d requests, want %d", got, want)
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	srv, n := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusTooManyRequests)
+	})
+	defer srv.Close()
+
+	client := dialStub(t, srv, &RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond})
+	keeper := NewKeeper(client, keyID1, nil)
+	_, err := keeper.Encrypt(context.Background(), []byte("test"))
+	if got, want := gcerrors.Code(err), gcerrors.Unavailable; got != want {
+		t.Errorf("got error code %v, want %v (err: %v)", got, want, err)
+	}
+	if got, want := atomic.LoadInt32(n), int32(3); got != want {
+		t.Errorf("got %d requests, want %d", got, want)
+	}
+}
+
+func TestErrorCodeStatus(t *testing.T) {
+	for _, test := range []struct {
+		status int
+		want   gcerrors.ErrorCode
+	}{
+		{http.StatusBadRequest, gcerrors.InvalidArgument},
+		{http.StatusForbidden, gcerrors.PermissionDenied},
+		{http.StatusNotFound, gcerrors.NotFound},
+		{http.StatusPreconditionFailed, gcerrors.FailedPrecondition},
+		{http.StatusTooManyRequests, gcerrors.ResourceExhausted},
+		{http.StatusInternalServerError, gcerrors.Internal},
+		{http.StatusBadGateway, gcerrors.Internal},
+		{http.StatusServiceUnavailable, gcerrors.Unavailable},
+		{http.StatusTeapot, gcerrors.Unknown},
+	} {
+		t.Run(strconv.Itoa(test.status), func(t *testing.T) {
+			srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+				writeError(w, test.status)
+			})
+			defer srv.Close()
+
+			client := dialStub(t, srv, nil)
+			// Disable the retries of the Vault client for 5xx responses.
+			client.SetMaxRetries(0)
+			keeper := NewKeeper(client, keyID1, nil)
+			_, err := keeper.Encrypt(context.Background(), []byte("test"))
+			if got := gcerrors.Code(err); got != test.want {
+				t.Errorf("got error code %v, want %v (err: %v)", got, test.want, err)
+			}
+		})
+	}
+}
+
+func TestMFA(t *testing.T) {
+	srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-MFA") != "my_totp:123456" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `{"errors":["permission denied: mfa validation failed"]}`)
+			return
+		}
+		writeCiphertext(w)
+	})
+	defer srv.Close()
+
+	keeper := NewKeeper(dialStub(t, srv, nil), keyID1, nil)
+	_, err := keeper.Encrypt(context.Background(), []byte("test"))
+	if got, want := gcerrors.Code(err), gcerrors.FailedPrecondition; got != want {
+		t.Errorf("without MFA: got error code %v, want %v (err: %v)", got, want, err)
+	}
+	ctx := WithMFA(context.Background(), "my_totp", "123456")
+	if _, err := keeper.Encrypt(ctx, []byte("test")); err != nil {
+		t.Errorf("with MFA: %v", err)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		ids = map[string][]string{} // request IDs by plaintext
+	)
+	srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		var body struct{ Plaintext []byte }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		ids[string(body.Plaintext)] = append(ids[string(body.Plaintext)], r.Header.Get(RequestIDHeader))
+		mu.Unlock()
+		writeCiphertext(w)
+	})
+	defer srv.Close()
+
+	keeper := NewKeeper(dialStub(t, srv, nil), keyID1, nil)
+	var wg sync.WaitGroup
+	for _, id := range []string{"req-1", "req-2"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			ctx := WithRequestID(context.Background(), id)
+			for i := 0; i < 10; i++ {
+				if _, err := keeper.Encrypt(ctx, []byte(id)); err != nil {
+					t.Error(err)
+				}
+			}
+		}(id)
+	}
+	wg.Wait()
+	if _, err := keeper.Encrypt(context.Background(), []byte("none")); err != nil {
+		t.Fatal(err)
+	}
+
+	for plaintext, want := range map[string]string{"req-1": "req-1", "req-2": "req-2", "none": ""} {
+		got := ids[plaintext]
+		if len(got) == 0 {
+			t.Errorf("%s: got no requests", plaintext)
+		}
+		for _, id := range got {
+			if id != want {
+				t.Errorf("%s: got request ID %q, want %q", plaintext, id, want)
+			}
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	te := octest.NewTestExporter(nil)
+	defer te.Unregister()
+
+	var traceparent string
+	srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		writeError(w, http.StatusBadRequest)
+	})
+	defer srv.Close()
+
+	keeper := NewKeeper(dialStub(t, srv, nil), keyID1, nil)
+	if _, err := keeper.Decrypt(context.Background(), []byte("vault:v1:Y2lwaGVydGV4dA==")); err == nil {
+		t.Fatal("got nil, want error")
+	}
+	var span *trace.SpanData
+	for _, s := range te.Spans() {
+		if s.Name == "vault.Decrypt" {
+			span = s
+		}
+	}
+	if span == nil {
+		t.Fatal("got no vault.Decrypt span")
+	}
+	if got, want := span.Status.Code, int32(gcerrors.InvalidArgument); got != want {
+		t.Errorf("got span status code %d, want %d", got, want)
+	}
+	if got := span.Attributes["key_id"]; got != keyID1 {
+		t.Errorf("got key_id attribute %v, want %q", got, keyID1)
+	}
+	if !strings.Contains(traceparent, span.TraceID.String()) {
+		t.Errorf("got traceparent header %q, want it to carry trace ID %s", traceparent, span.TraceID)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testVaultServer(t)
+	defer cleanup()
+
+	if err := CheckHealth(ctx, c); err != nil {
+		t.Fatalf("got %v, want healthy", err)
+	}
+	if err := c.Sys().Seal(); err != nil {
+		t.Fatal(err)
+	}
+	err := CheckHealth(ctx, c)
+	if got, want := gcerrors.Code(err), gcerrors.FailedPrecondition; got != want {
+		t.Errorf("got error code %v, want %v (err: %v)", got, want, err)
+	}
+}
+
+func TestCheckHealthStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		health string
+		want   gcerrors.ErrorCode
+	}{
+		{"active", `{"initialized":true,"sealed":false,"standby":false}`, gcerrors.OK},
+		{"sealed", `{"initialized":true,"sealed":true,"standby":false}`, gcerrors.FailedPrecondition},
+		{"standby", `{"initialized":true,"sealed":false,"standby":true}`, gcerrors.Unavailable},
+		{"uninitialized", `{"initialized":false,"sealed":true,"standby":false}`, gcerrors.FailedPrecondition},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, test.health)
+			})
+			defer srv.Close()
+
+			err := CheckHealth(context.Background(), dialStub(t, srv, nil))
+			if got := gcerrors.Code(err); got != test.want {
+				t.Errorf("got error code %v, want %v (err: %v)", got, test.want, err)
+			}
+		})
+	}
+}
+
+func TestCheckHealthDeadline(t *testing.T) {
+	done := make(chan struct{})
+	srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		// Hang until the test is over.
+		<-done
+	})
+	defer srv.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	client := dialStub(t, srv, nil)
+	start := time.Now()
+	err := CheckHealth(ctx, client)
+	if got, want := gcerrors.Code(err), gcerrors.DeadlineExceeded; got != want {
+		t.Errorf("got error code %v, want %v (err: %v)", got, want, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("CheckHealth returned after %v, want close to the 100ms deadline", elapsed)
+	}
+}
+
+func TestSealedServer(t *testing.T) {
+	srv, n := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, `{"errors":["Vault is sealed"]}`)
+	})
+	defer srv.Close()
+
+	client := dialStub(t, srv, &RetryPolicy{MaxAttempts: 5, BaseBackoff: time.Millisecond})
+	_, err := NewKeeper(client, keyID1, nil).Encrypt(context.Background(), []byte("test"))
+	if got, want := gcerrors.Code(err), gcerrors.FailedPrecondition; got != want {
+		t.Errorf("got error code %v, want %v (err: %v)", got, want, err)
+	}
+	// A sealed server is not retried.
+	if got := atomic.LoadInt32(n); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	done := make(chan struct{})
+	srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		// Hang until the test is over.
+		<-done
+	})
+	defer srv.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	keeper := NewKeeper(dialStub(t, srv, nil), keyID1, nil)
+	start := time.Now()
+	_, err := keeper.Encrypt(ctx, []byte("test"))
+	if got, want := gcerrors.Code(err), gcerrors.DeadlineExceeded; got != want {
+		t.Errorf("got error code %v, want %v (err: %v)", got, want, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Encrypt returned after %v, want close to the 100ms deadline", elapsed)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	// A server that refuses connections.
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	up, n := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		writeCiphertext(w)
+	})
+	defer up.Close()
+
+	client, err := Dial(context.Background(), &Config{
+		Token:     "<Client (Root) Token>",
+		Addresses: []string{down.URL, up.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keeper := NewKeeper(client, keyID1, nil)
+	if _, err := keeper.Encrypt(context.Background(), []byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := atomic.LoadInt32(n), int32(1); got != want {
+		t.Errorf("got %d requests to the second address, want %d", got, want)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	var got string
+	srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-Proxy-Auth")
+		writeCiphertext(w)
+	})
+	defer srv.Close()
+
+	client, err := Dial(context.Background(), &Config{
+		Token:     "<Client (Root) Token>",
+		APIConfig: api.Config{Address: srv.URL},
+		Headers:   map[string]string{"X-Proxy-Auth": "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keeper := NewKeeper(client, keyID1, nil)
+	if _, err := keeper.Encrypt(context.Background(), []byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	if want := "secret"; got != want {
+		t.Errorf("got header %q, want %q", got, want)
+	}
+}
+
+func TestReservedHeaders(t *testing.T) {
+	for _, name := range []string{"X-Vault-Token", "x-vault-namespace"} {
+		_, err := Dial(context.Background(), &Config{
+			Headers: map[string]string{name: "value"},
+		})
+		if err == nil {
+			t.Errorf("%s: got nil, want reserved header error", name)
+		}
+	}
+}
+
+func TestDecryptWithInfo(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, nil); err != nil {
+		t.Fatal(err)
+	}
+	key := NewKey(c, keyID1, nil)
+	encrypt := func(plaintext string) []byte {
+		ciphertext, err := key.Keeper().Encrypt(ctx, []byte(plaintext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ciphertext
+	}
+	v1 := encrypt("one")
+	for i := 0; i < 2; i++ {
+		if err := key.RotateKey(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v3 := encrypt("three")
+
+	for _, test := range []struct {
+		ciphertext []byte
+		plaintext  string
+		version    int
+	}{
+		{v1, "one", 1},
+		{v3, "three", 3},
+	} {
+		plaintext, version, err := key.DecryptWithInfo(ctx, test.ciphertext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(plaintext) != test.plaintext {
+			t.Errorf("got %q, want %q", plaintext, test.plaintext)
+		}
+		if version != test.version {
+			t.Errorf("%s: got key version %d, want %d", test.ciphertext, version, test.version)
+		}
+	}
+
+	_, _, err := key.DecryptWithInfo(ctx, []byte("not a ciphertext"))
+	if got, want := gcerrors.Code(err), gcerrors.InvalidArgument; got != want {
+		t.Errorf("got error code %v, want %v (err: %v)", got, want, err)
+	}
+}
+
+func TestKeyVersion(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	keeper := NewKeeper(c, keyID1, nil)
+	v1, err := keeper.Encrypt(ctx, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Logical().Write("transit/keys/"+keyID1+"/rotate", nil); err != nil {
+		t.Fatal(err)
+	}
+	v2, err := keeper.Encrypt(ctx, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		ciphertext []byte
+		want       int
+	}{
+		{v1, 1},
+		{v2, 2},
+	} {
+		got, err := KeyVersion(test.ciphertext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%s: got version %d, want %d", test.ciphertext, got, test.want)
+		}
+	}
+}
+
+func TestKeyVersionMalformed(t *testing.T) {
+	for _, ciphertext := range []string{"", "ciphertext", "vault:1:abc", "vault:vx:abc", "other:v1:abc"} {
+		if _, err := KeyVersion([]byte(ciphertext)); err == nil {
+			t.Errorf("%q: got nil, want error", ciphertext)
+		}
+	}
+}
+
+func TestDecryptWithKey(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	ca, err := NewKeeper(c, keyID1, nil).Encrypt(ctx, []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, err := NewKeeper(c, keyID2, nil).Encrypt(ctx, []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The key of the *Key is neither of the keys used to encrypt.
+	key := NewKey(c, "other", nil)
+	for _, test := range []struct {
+		keyName    string
+		ciphertext []byte
+		want       string
+	}{
+		{keyID1, ca, "a"},
+		{keyID2, cb, "b"},
+	} {
+		got, err := key.DecryptWithKey(ctx, test.keyName, test.ciphertext)
+		if err != nil {
+			t.Errorf("%s: %v", test.keyName, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.keyName, got, test.want)
+		}
+	}
+	_, err = key.DecryptWithKey(ctx, keyID2, ca)
+	if err == nil {
+		t.Error("decrypt with the wrong key: got nil, want error")
+	}
+}
+
+func TestEmbedKeyName(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	opts := &KeeperOptions{EmbedKeyName: true}
+	ca, err := NewKeeper(c, keyID1, opts).Encrypt(ctx, []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(ca, []byte(keyID1+":vault:v1:")) {
+		t.Errorf("got ciphertext %q, want it prefixed with the key name", ca)
+	}
+	cb, err := NewKeeper(c, keyID2, opts).Encrypt(ctx, []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := NewKeeper(c, keyID2, nil).Encrypt(ctx, []byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A single keeper decrypts ciphertexts embedding any key name, and
+	// ciphertexts of its own key without one.
+	keeper := NewKeeper(c, keyID2, opts)
+	for _, test := range []struct {
+		ciphertext []byte
+		want       string
+	}{
+		{ca, "a"},
+		{cb, "b"},
+		{plain, "c"},
+	} {
+		got, err := keeper.Decrypt(ctx, test.ciphertext)
+		if err != nil {
+			t.Errorf("%s: %v", test.ciphertext, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.ciphertext, got, test.want)
+		}
+	}
+	if v, err := KeyVersion(ca); err != nil || v != 1 {
+		t.Errorf("KeyVersion: got %d, %v, want 1", v, err)
+	}
+
+	// The batch methods prefix the ciphertexts they return, and accept
+	// ciphertexts naming the key of the keeper, or no key.
+	key := NewKey(c, keyID2, opts)
+	batch, err := key.BatchEncrypt(ctx, [][]byte{[]byte("d")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(batch[0], []byte(keyID2+":vault:v1:")) {
+		t.Errorf("BatchEncrypt: got ciphertext %q, want it prefixed with the key name", batch[0])
+	}
+	rewrapped, err := key.BatchRewrap(ctx, [][]byte{batch[0], cb, plain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range rewrapped {
+		if !bytes.HasPrefix(c, []byte(keyID2+":vault:v1:")) {
+			t.Errorf("BatchRewrap: got ciphertext %q, want it prefixed with the key name", c)
+		}
+	}
+	got, err := key.BatchDecrypt(ctx, append([][]byte{batch[0], cb, plain}, rewrapped...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"d", "b", "c", "d", "b", "c"}; len(got) != len(want) {
+		t.Errorf("BatchDecrypt: got %d plaintexts, want %d", len(got), len(want))
+	} else {
+		for i := range want {
+			if string(got[i]) != want[i] {
+				t.Errorf("BatchDecrypt: got %q at %d, want %q", got[i], i, want[i])
+			}
+		}
+	}
+	// A batch is sent to a single key, so ciphertexts of other keys are
+	// rejected.
+	if _, err := key.BatchDecrypt(ctx, [][]byte{cb, ca}); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("BatchDecrypt with another key: got error %v, want code %v", err, gcerrors.InvalidArgument)
+	}
+	if _, err := key.BatchRewrap(ctx, [][]byte{ca}); gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Errorf("BatchRewrap with another key: got error %v, want code %v", err, gcerrors.InvalidArgument)
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	names, err := ListKeys(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("got keys %v before creating any, want none", names)
+	}
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Logical().Write("transit/keys/"+keyID2, map[string]interface{}{"type": "ed25519"}); err != nil {
+		t.Fatal(err)
+	}
+	names, err = ListKeys(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if want := []string{keyID1, keyID2}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got keys %v, want %v", names, want)
+	}
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID2+"/rotate", nil); err != nil {
+		t.Fatal(err)
+	}
+	info, err := ReadKeyInfo(ctx, c, keyID2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &KeyInfo{
+		Name:                 keyID2,
+		Type:                 "ed25519",
+		LatestVersion:        2,
+		MinDecryptionVersion: 1,
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+
+	_, err = ReadKeyInfo(ctx, c, "missing")
+	if got, want := gcerrors.Code(err), gcerrors.NotFound; got != want {
+		t.Errorf("missing key: got error code %v, want %v (err: %v)", got, want, err)
+	}
+}
+
+func TestSetMinDecryptionVersion(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	key := NewKey(c, keyID1, nil)
+	keeper := key.Keeper()
+	v1, err := keeper.Encrypt(ctx, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Logical().Write("transit/keys/"+keyID1+"/rotate", nil); err != nil {
+		t.Fatal(err)
+	}
+	v2, err := keeper.Encrypt(ctx, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.SetMinDecryptionVersion(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	_, err = keeper.Decrypt(ctx, v1)
+	if got, want := gcerrors.Code(err), gcerrors.FailedPrecondition; got != want {
+		t.Errorf("v1: got error code %v, want %v (err: %v)", got, want, err)
+	}
+	if _, err := keeper.Decrypt(ctx, v2); err != nil {
+		t.Errorf("v2: %v", err)
+	}
+}
+
+func TestTrimKey(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	key := NewKey(c, keyID1, nil)
+	keeper := key.Keeper()
+	v1, err := keeper.Encrypt(ctx, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Logical().Write("transit/keys/"+keyID1+"/rotate", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v3, err := keeper.Encrypt(ctx, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.SetMinDecryptionVersion(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	err = key.TrimKey(ctx, 3)
+	if got, want := gcerrors.Code(err), gcerrors.InvalidArgument; got != want {
+		t.Errorf("trim past the minimum decryption version: got error code %v, want %v (err: %v)", got, want, err)
+	}
+	if err := key.TrimKey(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keeper.Decrypt(ctx, v1); err == nil {
+		t.Error("v1: got nil, want error")
+	}
+	secret, err := c.Logical().Read("transit/keys/" + keyID1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := secret.Data["keys"].(map[string]interface{})["1"]; ok {
+		t.Error("got version 1 still available, want it trimmed")
+	}
+	if _, err := keeper.Decrypt(ctx, v3); err != nil {
+		t.Errorf("v3: %v", err)
+	}
+}
+
+func TestUpdateKeyConfig(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Logical().Write("transit/keys/"+keyID1+"/rotate", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := NewKey(c, keyID1, nil)
+	cfg := KeyConfig{
+		MinDecryptionVersion: 2,
+		MinEncryptionVersion: 3,
+		DeletionAllowed:      true,
+		Exportable:           true,
+	}
+	if err := key.UpdateKeyConfig(ctx, cfg); err != nil {
+		t.Fatal(err)
+	}
+	info, err := ReadKeyInfo(ctx, c, keyID1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &KeyInfo{
+		Name:                 keyID1,
+		Type:                 "aes256-gcm96",
+		LatestVersion:        3,
+		MinDecryptionVersion: 2,
+		MinEncryptionVersion: 3,
+		Exportable:           true,
+		DeletionAllowed:      true,
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+
+	err = key.UpdateKeyConfig(ctx, KeyConfig{MinEncryptionVersion: 4})
+	if got, want := gcerrors.Code(err), gcerrors.InvalidArgument; got != want {
+		t.Errorf("min encryption version past the latest: got error code %v, want %v (err: %v)", got, want, err)
+	}
+}
+
+func TestEncryptBinary(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	keeper := NewKeeper(c, keyID1, nil)
+	for _, test := range []struct {
+		name      string
+		plaintext []byte
+	}{
+		{"nil", nil},
+		{"empty", []byte{}},
+		{"NUL", []byte{0}},
+		{"random", random},
+	} {
+		ciphertext, err := keeper.Encrypt(ctx, test.plaintext)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		got, err := keeper.Decrypt(ctx, ciphertext)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(got, test.plaintext) {
+			t.Errorf("%s: got %x, want %x", test.name, got, test.plaintext)
+		}
+	}
+}
+
+func TestConvergentEncryption(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, map[string]interface{}{
+		"derived":               true,
+		"convergent_encryption": true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	keeper := NewKeeper(c, keyID1, &KeeperOptions{
+		Context: []byte("context"),
+		Nonce:   []byte("0123456789ab"),
+	})
+	plaintext := []byte("test")
+	c1, err := keeper.Encrypt(ctx, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := keeper.Encrypt(ctx, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c1, c2) {
+		t.Errorf("got different ciphertexts %q and %q, want identical", c1, c2)
+	}
+	got, err := keeper.Decrypt(ctx, c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("got %q, want %q", got, plaintext)
+	}
+}
+
+func TestDerivationContext(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, map[string]interface{}{
+		"derived": true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	keeper := NewKeeper(c, keyID1, nil)
+	ctxA := WithDerivationContext(ctx, []byte("tenant-A"))
+	ctxB := WithDerivationContext(ctx, []byte("tenant-B"))
+	plaintext := []byte("test")
+	ciphertext, err := keeper.Encrypt(ctxA, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keeper.Decrypt(ctxB, ciphertext); err == nil {
+		t.Error("decrypt with another context: got nil, want error")
+	}
+	got, err := keeper.Decrypt(ctxA, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("got %q, want %q", got, plaintext)
+	}
+}
+
+func TestContextFromRequest(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, map[string]interface{}{
+		"derived": true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	type tenantKey struct{}
+	keeper := NewKeeper(c, keyID1, &KeeperOptions{
+		ContextFromRequest: func(ctx context.Context) []byte {
+			if id, ok := ctx.Value(tenantKey{}).(string); ok {
+				return []byte("tenant-" + id)
+			}
+			return nil
+		},
+	})
+	ctxA := context.WithValue(ctx, tenantKey{}, "A")
+	ctxB := context.WithValue(ctx, tenantKey{}, "B")
+	plaintext := []byte("test")
+	ciphertext, err := keeper.Encrypt(ctxA, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := keeper.Decrypt(ctxA, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("got %q, want %q", got, plaintext)
+	}
+	if _, err := keeper.Decrypt(ctxB, ciphertext); err == nil {
+		t.Error("decrypt as another tenant: got nil, want error")
+	}
+	// WithDerivationContext takes precedence.
+	got, err = keeper.Decrypt(WithDerivationContext(ctxB, []byte("tenant-A")), ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("got %q, want %q", got, plaintext)
+	}
+}
+
+func TestDerivationContextRotation(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, map[string]interface{}{
+		"derived": true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	keeper := NewKeeper(c, keyID1, &KeeperOptions{Context: []byte("tenant-A")})
+	plaintext := []byte("test")
+	v1, err := keeper.Encrypt(ctx, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Logical().Write("transit/keys/"+keyID1+"/rotate", nil); err != nil {
+		t.Fatal(err)
+	}
+	v2, err := keeper.Encrypt(ctx, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(v2, []byte("vault:v2:")) {
+		t.Errorf("got ciphertext %q, want it produced with version 2", v2)
+	}
+	for _, ciphertext := range [][]byte{v1, v2} {
+		got, err := keeper.Decrypt(ctx, ciphertext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("got %q, want %q", got, plaintext)
+		}
+	}
+
+	// A mismatched or missing context is reported as such.
+	_, err = keeper.Decrypt(WithDerivationContext(ctx, []byte("tenant-B")), v1)
+	if got, want := gcerrors.Code(err), gcerrors.FailedPrecondition; got != want {
+		t.Errorf("another context: got error code %v, want %v (err: %v)", got, want, err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "derivation context") {
+		t.Errorf("another context: got %q, want it to mention the derivation context", err)
+	}
+	_, err = keeper.Decrypt(WithDerivationContext(ctx, nil), v1)
+	if got, want := gcerrors.Code(err), gcerrors.FailedPrecondition; got != want {
+		t.Errorf("no context: got error code %v, want %v (err: %v)", got, want, err)
+	}
+}
+
+func TestAssociatedDataRequest(t *testing.T) {
+	var got []string
+	srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/sys/health" {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"initialized":true,"sealed":false,"standby":false,"version":"1.13.1"}`)
+			return
+		}
+		var body struct {
+			AssociatedData []byte `json:"associated_data"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest)
+			return
+		}
+		got = append(got, string(body.AssociatedData))
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"data":{"ciphertext":"vault:v1:Y2lwaGVydGV4dA==","plaintext":"dGVzdA=="}}`)
+	})
+	defer srv.Close()
+
+	ctx := WithAssociatedData(context.Background(), []byte("rec-1"))
+	keeper := NewKeeper(dialStub(t, srv, nil), keyID1, nil)
+	ciphertext, err := keeper.Encrypt(ctx, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keeper.Decrypt(ctx, ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keeper.Encrypt(context.Background(), []byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"rec-1", "rec-1", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got associated data %q, want %q", got, want)
+	}
+}
+
+func TestAssociatedDataUnsupported(t *testing.T) {
+	var health, transit int32
+	srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/v1/sys/health" {
+			atomic.AddInt32(&health, 1)
+			io.WriteString(w, `{"initialized":true,"sealed":false,"standby":false,"version":"1.12.3"}`)
+			return
+		}
+		atomic.AddInt32(&transit, 1)
+		io.WriteString(w, `{"data":{"ciphertext":"vault:v1:Y2lwaGVydGV4dA==","plaintext":"dGVzdA=="}}`)
+	})
+	defer srv.Close()
+
+	ctx := WithAssociatedData(context.Background(), []byte("rec-1"))
+	key := NewKey(dialStub(t, srv, nil), keyID1, nil)
+	if _, err := key.Keeper().Encrypt(ctx, []byte("test")); gcerrors.Code(err) != gcerrors.FailedPrecondition {
+		t.Errorf("Encrypt: got error %v, want code %v", err, gcerrors.FailedPrecondition)
+	}
+	if _, err := key.Keeper().Decrypt(ctx, []byte("vault:v1:Y2lwaGVydGV4dA==")); gcerrors.Code(err) != gcerrors.FailedPrecondition {
+		t.Errorf("Decrypt: got error %v, want code %v", err, gcerrors.FailedPrecondition)
+	}
+	if _, err := key.BatchEncrypt(ctx, [][]byte{[]byte("test")}); gcerrors.Code(err) != gcerrors.FailedPrecondition {
+		t.Errorf("BatchEncrypt: got error %v, want code %v", err, gcerrors.FailedPrecondition)
+	}
+	if _, err := key.BatchDecrypt(ctx, [][]byte{[]byte("vault:v1:Y2lwaGVydGV4dA==")}); gcerrors.Code(err) != gcerrors.FailedPrecondition {
+		t.Errorf("BatchDecrypt: got error %v, want code %v", err, gcerrors.FailedPrecondition)
+	}
+	if got := atomic.LoadInt32(&transit); got != 0 {
+		t.Errorf("got %d requests to the transit engine, want none", got)
+	}
+	if got := atomic.LoadInt32(&health); got != 1 {
+		t.Errorf("got %d reads of the server version, want 1", got)
+	}
+	// Operations without associated data are unaffected.
+	if _, err := key.Keeper().Encrypt(context.Background(), []byte("test")); err != nil {
+		t.Error(err)
+	}
+}
+
+// serverSupports reports whether the Vault server used by c has at least the
+// given major and minor version.
+func serverSupports(t *testing.T, c *api.Client, major, minor int) bool {
+	h, err := c.Sys().Health()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return versionAtLeast(h.Version, major, minor)
+}
+
+func TestAssociatedData(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	keeper := NewKeeper(c, keyID1, nil)
+	plaintext := []byte("test")
+	if !serverSupports(t, c, 1, 13) {
+		// The server would ignore the associated data.
+		_, err := keeper.Encrypt(WithAssociatedData(ctx, []byte("rec-1")), plaintext)
+		if got, want := gcerrors.Code(err), gcerrors.FailedPrecondition; got != want {
+			t.Errorf("got error %v, want code %v", err, want)
+		}
+		return
+	}
+
+	ciphertext, err := keeper.Encrypt(WithAssociatedData(ctx, []byte("rec-1")), plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keeper.Decrypt(WithAssociatedData(ctx, []byte("rec-2")), ciphertext); err == nil {
+		t.Error("decrypt with other associated data: got nil, want error")
+	}
+	got, err := keeper.Decrypt(WithAssociatedData(ctx, []byte("rec-1")), ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("got %q, want %q", got, plaintext)
+	}
+}
+
+func TestInvalidNonce(t *testing.T) {
+	keeper := NewKeeper(nil, keyID1, &KeeperOptions{Nonce: []byte("short")})
+	if _, err := keeper.Encrypt(context.Background(), []byte("test")); err == nil {
+		t.Error("got nil, want invalid nonce error")
+	}
+}
+
+func TestGenerateRandom(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	r1, err := GenerateRandom(ctx, c, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(r1), 32; got != want {
+		t.Errorf("got %d bytes, want %d", got, want)
+	}
+	r2, err := GenerateRandom(ctx, c, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(r1, r2) {
+		t.Error("got the same random bytes twice")
+	}
+	if _, err := GenerateRandom(ctx, c, 0); err == nil {
+		t.Error("got nil, want invalid number of bytes error")
+	}
+}
+
+func TestGenerateRandomNoData(t *testing.T) {
+	ctx := context.Background()
+	srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		if i == 0 {
+			writeError(w, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"data":{}}`)
+	})
+	defer srv.Close()
+	client := dialStub(t, srv, nil)
+
+	if _, err := GenerateRandom(ctx, client, 32); gcerrors.Code(err) != gcerrors.NotFound {
+		t.Errorf("got error %v, want code %v", err, gcerrors.NotFound)
+	}
+	if _, err := GenerateRandom(ctx, client, 32); err == nil {
+		t.Error("got nil, want error for a response without random bytes")
+	}
+}
+
+func TestEncryptNoCiphertext(t *testing.T) {
+	srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"data":{}}`)
+	})
+	defer srv.Close()
+
+	keeper := NewKeeper(dialStub(t, srv, nil), keyID1, nil)
+	if _, err := keeper.Encrypt(context.Background(), []byte("test")); err == nil {
+		t.Error("got nil, want error for a response without a ciphertext")
+	}
+}
+
+func TestExportKey(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, map[string]interface{}{
+		"exportable": true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Logical().Write("transit/keys/"+keyID1+"/rotate", nil); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKey(c, keyID1, nil).ExportKey(ctx, "encryption-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(keys), 2; got != want {
+		t.Fatalf("got %d versions, want %d", got, want)
+	}
+	for _, v := range []int{1, 2} {
+		if keys[v] == "" {
+			t.Errorf("got no material for version %d", v)
+		}
+	}
+}
+
+func TestExportKeyNotExportable(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err := NewKey(c, keyID1, nil).ExportKey(ctx, "encryption-key")
+	if got, want := gcerrors.Code(err), gcerrors.PermissionDenied; got != want {
+		t.Errorf("got error code %v, want %v (err: %v)", got, want, err)
+	}
+}
+
+func TestErrorAsResponseError(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	keeper := NewKeeper(c, "missing-key", nil)
+	_, err := keeper.Decrypt(ctx, []byte("vault:v1:aGVsbG8="))
+	if err == nil {
+		t.Fatal("got nil, want error")
+	}
+	var respErr *ResponseError
+	if !keeper.ErrorAs(err, &respErr) {
+		t.Fatalf("got ErrorAs false for %v, want true", err)
+	}
+	if got, want := respErr.StatusCode, http.StatusBadRequest; got != want {
+		t.Errorf("got status code %d, want %d", got, want)
+	}
+	if len(respErr.Errors) == 0 {
+		t.Error("got no error messages, want some")
+	}
+}
+
+func TestWrapDataKey(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, nil); err != nil {
+		t.Fatal(err)
+	}
+	key := NewKey(c, keyID1, &KeeperOptions{WrapTTL: time.Minute})
+	token, err := key.WrapDataKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Unwrap(ctx, c, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(data["plaintext"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := key.Keeper().Decrypt(ctx, []byte(data["ciphertext"].(string)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Error("got decrypted data key different from the unwrapped one")
+	}
+	if _, err := Unwrap(ctx, c, token); err == nil {
+		t.Error("got nil unwrapping the token twice, want error")
+	}
+}
+
+func TestWrapWithoutTTL(t *testing.T) {
+	if _, err := NewKey(nil, keyID1, nil).WrapDataKey(context.Background()); err == nil {
+		t.Error("got nil, want error")
+	}
+}
+
+func TestBatchDecryptPartialFailure(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, nil); err != nil {
+		t.Fatal(err)
+	}
+	key := NewKey(c, keyID1, nil)
+	var plaintexts [][]byte
+	for i := 0; i < 5; i++ {
+		plaintexts = append(plaintexts, []byte(fmt.Sprintf("message %d", i)))
+	}
+	ciphertexts, err := key.BatchEncrypt(ctx, plaintexts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const corrupt = 2
+	ciphertexts[corrupt] = []byte("vault:v1:corrupt")
+
+	got, err := key.BatchDecrypt(ctx, ciphertexts)
+	var batchErr *BatchError
+	if !key.Keeper().ErrorAs(err, &batchErr) {
+		t.Fatalf("got error %v, want a *BatchError", err)
+	}
+	if len(batchErr.Items) != 1 || batchErr.Items[0].Index != corrupt {
+		t.Errorf("got failed items %+v, want only index %d", batchErr.Items, corrupt)
+	}
+	for i, p := range plaintexts {
+		if i == corrupt {
+			if got[i] != nil {
+				t.Errorf("got plaintext %q for the corrupt item, want nil", got[i])
+			}
+			continue
+		}
+		if !bytes.Equal(got[i], p) {
+			t.Errorf("item %d: got %q, want %q", i, got[i], p)
+		}
+	}
+}
+
+func TestBatchRewrap(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, nil); err != nil {
+		t.Fatal(err)
+	}
+	key := NewKey(c, keyID1, nil)
+	var plaintexts [][]byte
+	for i := 0; i < 100; i++ {
+		plaintexts = append(plaintexts, []byte(fmt.Sprintf("message %d", i)))
+	}
+	ciphertexts, err := key.BatchEncrypt(ctx, plaintexts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Logical().Write("transit/keys/"+keyID1+"/rotate", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rewrapped, err := key.BatchRewrap(ctx, ciphertexts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rewrapped) != len(ciphertexts) {
+		t.Fatalf("got %d ciphertexts, want %d", len(rewrapped), len(ciphertexts))
+	}
+	got, err := key.BatchDecrypt(ctx, rewrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range plaintexts {
+		if !bytes.HasPrefix(rewrapped[i], []byte("vault:v2:")) {
+			t.Errorf("item %d: got ciphertext %q, want it produced with version 2", i, rewrapped[i])
+		}
+		if !bytes.Equal(got[i], p) {
+			t.Errorf("item %d: got %q, want %q", i, got[i], p)
+		}
+	}
+}
+
+func TestEncryptKeyVersion(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Logical().Write("transit/keys/"+keyID1+"/rotate", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keeper := NewKeeper(c, keyID1, &KeeperOptions{EncryptKeyVersion: 2})
+	plaintext := []byte("test")
+	ciphertext, err := keeper.Encrypt(ctx, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(ciphertext, []byte("vault:v2:")) {
+		t.Errorf("got ciphertext %q, want it produced with version 2", ciphertext)
+	}
+	got, err := keeper.Decrypt(ctx, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("got %q, want %q", got, plaintext)
+	}
+
+	// The version of the keeper can be overridden for a single operation.
+	ciphertext, err = keeper.Encrypt(WithEncryptKeyVersion(ctx, 0), plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(ciphertext, []byte("vault:v3:")) {
+		t.Errorf("got ciphertext %q, want it produced with the latest version", ciphertext)
+	}
+
+	_, err = keeper.Encrypt(WithEncryptKeyVersion(ctx, 4), plaintext)
+	if got, want := gcerrors.Code(err), gcerrors.InvalidArgument; got != want {
+		t.Errorf("got error code %v, want %v (err: %v)", got, want, err)
+	}
+}
+
+// transitPolicy allows using the Transit Secrets Engine.
+const transitPolicy = `path "transit/*" { capabilities = ["create", "read", "update"] }`
+
+// setupUserpass enables the userpass auth method with a user allowed to use
+// the Transit Secrets Engine.
+func setupUserpass(t *testing.T, c *api.Client) {
+	if err := c.Sys().PutPolicy("transit", transitPolicy); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sys().EnableAuthWithOptions("userpass", &api.EnableAuthOptions{Type: "userpass"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Logical().Write("auth/userpass/users/app", map[string]interface{}{
+		"password": "secret",
+		"policies": "transit",
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyCapabilities(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	key := NewKey(c, keyID1, nil)
+	if err := key.VerifyCapabilities(ctx); err != nil {
+		t.Fatalf("root token: %v", err)
+	}
+
+	const encryptOnly = `path "transit/encrypt/*" { capabilities = ["update"] }`
+	if err := c.Sys().PutPolicy("encrypt-only", encryptOnly); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := c.Auth().Token().Create(&api.TokenCreateRequest{Policies: []string{"encrypt-only"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetToken(secret.Auth.ClientToken)
+	err = key.VerifyCapabilities(ctx)
+	if got, want := gcerrors.Code(err), gcerrors.PermissionDenied; got != want {
+		t.Fatalf("got error code %v, want %v (err: %v)", got, want, err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "transit/decrypt/"+keyID1) || strings.Contains(msg, "transit/encrypt/") {
+		t.Errorf("got %q, want only the decrypt capability reported missing", msg)
+	}
+}
+
+func TestUserpassAuth(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+	setupUserpass(t, c)
+
+	client, err := Dial(ctx, &Config{
+		APIConfig: testAPIConfig(c),
+		Userpass:  &UserpassAuth{Username: "app", Password: "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keeper := NewKeeper(client, keyID1, nil)
+	if _, err := keeper.Encrypt(ctx, []byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	token := client.Token()
+	if err := c.Auth().Token().RevokeTree(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keeper.Encrypt(ctx, []byte("test")); err != nil {
+		t.Fatalf("after the token was revoked: %v", err)
+	}
+	if client.Token() == token {
+		t.Error("got the revoked token still in use, want a new one")
+	}
+}
+
+func TestUserpassAuthWrongPassword(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+	setupUserpass(t, c)
+
+	_, err := Dial(ctx, &Config{
+		APIConfig: testAPIConfig(c),
+		Userpass:  &UserpassAuth{Username: "app", Password: "wrong"},
+	})
+	if got, want := gcerrors.Code(err), gcerrors.PermissionDenied; got != want {
+		t.Errorf("got error code %v, want %v (err: %v)", got, want, err)
+	}
+}
+
+func setupAppRole(t *testing.T, c *api.Client) (roleID, secretID string) {
+	if err := c.Sys().PutPolicy("transit", transitPolicy); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sys().EnableAuthWithOptions("approle", &api.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Logical().Write("auth/approle/role/app", map[string]interface{}{
+		"policies": "transit",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := c.Logical().Read("auth/approle/role/app/role-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roleID = secret.Data["role_id"].(string)
+	secret, err = c.Logical().Write("auth/approle/role/app/secret-id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return roleID, secret.Data["secret_id"].(string)
+}
+
+// testAPIConfig returns the configuration to Dial the test server used by c.
+func testAPIConfig(c *api.Client) api.Config {
+	return api.Config{
+		Address: c.Address(),
+		HttpClient: &http.Client{
+			Transport: &http.Transport{
+				// The test cluster uses a self-signed certificate.
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	}
+}
+
+func TestRequestObserver(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	type call struct {
+		op  string
+		d   time.Duration
+		err error
+	}
+	var (
+		mu    sync.Mutex
+		calls []call
+	)
+	client, err := Dial(ctx, &Config{
+		Token:     c.Token(),
+		APIConfig: testAPIConfig(c),
+		RequestObserver: func(op string, d time.Duration, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, call{op, d, err})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keeper := NewKeeper(client, keyID1, nil)
+	var want []string
+	for i := 0; i < 3; i++ {
+		ciphertext, err := keeper.Encrypt(ctx, []byte("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := keeper.Decrypt(ctx, ciphertext); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, "encrypt", "decrypt")
+	}
+	if _, err := keeper.Decrypt(ctx, []byte("vault:v1:corrupt")); err == nil {
+		t.Fatal("got nil decrypting a corrupt ciphertext, want error")
+	}
+	want = append(want, "decrypt")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != len(want) {
+		t.Fatalf("got %d observed calls, want %d", len(calls), len(want))
+	}
+	for i, got := range calls {
+		if got.op != want[i] {
+			t.Errorf("call %d: got op %q, want %q", i, got.op, want[i])
+		}
+		if got.d < 0 {
+			t.Errorf("call %d: got negative duration %v", i, got.d)
+		}
+		if wantErr := i == len(calls)-1; (got.err != nil) != wantErr {
+			t.Errorf("call %d: got error %v, want error: %t", i, got.err, wantErr)
+		}
+	}
+}
+
+func TestAppRoleReauthenticate(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+	roleID, secretID := setupAppRole(t, c)
+
+	client, err := Dial(ctx, &Config{
+		APIConfig: testAPIConfig(c),
+		AppRole:   &AppRoleAuth{RoleID: roleID, SecretID: secretID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keeper := NewKeeper(client, keyID1, nil)
+	if _, err := keeper.Encrypt(ctx, []byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	token := client.Token()
+	if err := c.Auth().Token().RevokeTree(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keeper.Encrypt(ctx, []byte("test")); err != nil {
+		t.Fatalf("after the token was revoked: %v", err)
+	}
+	if client.Token() == token {
+		t.Error("got the revoked token still in use, want a new one")
+	}
+}
+
+func TestAppRoleWrappedSecretID(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+	roleID, _ := setupAppRole(t, c)
+
+	// wrappedSecretID returns a wrapping token for a new SecretID.
+	wrappedSecretID := func() string {
+		secret, err := request(ctx, c, http.MethodPut, "auth/approle/role/app/secret-id", nil, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return secret.WrapInfo.Token
+	}
+
+	client, err := Dial(ctx, &Config{
+		APIConfig: testAPIConfig(c),
+		AppRole:   &AppRoleAuth{RoleID: roleID, WrappedSecretIDToken: wrappedSecretID()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKeeper(client, keyID1, nil).Encrypt(ctx, []byte("test")); err != nil {
+		t.Fatal(err)
+	}
+
+	token := wrappedSecretID()
+	if _, err := Unwrap(ctx, c, token); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Dial(ctx, &Config{
+		APIConfig: testAPIConfig(c),
+		AppRole:   &AppRoleAuth{RoleID: roleID, WrappedSecretIDToken: token},
+	})
+	if got, want := gcerrors.Code(err), gcerrors.PermissionDenied; got != want {
+		t.Errorf("used wrapping token: got error code %v, want %v (err: %v)", got, want, err)
+	}
+}
+
+func TestRevokedTokenWithoutAuthMethod(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	secret, err := c.Auth().Token().Create(&api.TokenCreateRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Dial(ctx, &Config{
+		Token:     secret.Auth.ClientToken,
+		APIConfig: testAPIConfig(c),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Auth().Token().RevokeTree(secret.Auth.ClientToken); err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewKeeper(client, keyID1, nil).Encrypt(ctx, []byte("test"))
+	if got, want := gcerrors.Code(err), gcerrors.PermissionDenied; got != want {
+		t.Errorf("got error code %v, want %v (err: %v)", got, want, err)
+	}
+}
+
+func TestKeeperAs(t *testing.T) {
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	keeper := NewKeeper(c, keyID1, nil)
+	var client *api.Client
+	if !keeper.As(&client) {
+		t.Fatal("got As(**api.Client) false, want true")
+	}
+	if client != c {
+		t.Error("got a different client than the keeper's")
+	}
+	if _, err := client.Sys().Health(); err != nil {
+		t.Error(err)
+	}
+	if keeper.As(&api.Client{}) {
+		t.Error("got As(*api.Client) true, want false")
+	}
+}
+
+func TestEncryptLarge(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, nil); err != nil {
+		t.Fatal(err)
+	}
+	key := NewKey(c, keyID1, nil)
+	payload := make([]byte, 10<<20)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+	var encrypted bytes.Buffer
+	if err := key.EncryptLarge(ctx, bytes.NewReader(payload), &encrypted); err != nil {
+		t.Fatal(err)
+	}
+	sealed := encrypted.Bytes()
+
+	var decrypted bytes.Buffer
+	if err := key.DecryptLarge(ctx, bytes.NewReader(sealed), &decrypted); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted.Bytes(), payload) {
+		t.Error("got decrypted payload different from the original")
+	}
 
-func TestConformance(t *testing.T) {
-	drivertest.RunConformanceTests(t, newHarness, []drivertest.AsTest{verifyAs{}})
+	// Dropping the last chunk must be detected.
+	truncated := sealed[:len(sealed)-(4+chunkSize+16)]
+	if err := key.DecryptLarge(ctx, bytes.NewReader(truncated), ioutil.Discard); err == nil {
+		t.Error("truncated: got nil, want error")
+	}
 }
 
-type verifyAs struct{}
+func TestSignVerify(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
 
-func (v verifyAs) Name() string {
-	return "verify As function"
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, map[string]interface{}{
+		"type": "rsa-2048",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	key := NewKey(c, keyID1, nil)
+	input := []byte("message to sign")
+	pss := &SignOptions{HashAlgorithm: "sha2-512", SignatureAlgorithm: "pss"}
+	sig, err := key.Sign(ctx, input, pss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := key.Verify(ctx, input, sig, pss); err != nil || !ok {
+		t.Errorf("pss: got %v, %v, want true, nil", ok, err)
+	}
+	pkcs1 := &SignOptions{HashAlgorithm: "sha2-512", SignatureAlgorithm: "pkcs1v15"}
+	if ok, err := key.Verify(ctx, input, sig, pkcs1); err != nil || ok {
+		t.Errorf("pkcs1v15: got %v, %v, want false, nil", ok, err)
+	}
 }
 
-func (v verifyAs) ErrorCheck(k *secrets.Keeper, err error) error {
-	var s string
-	if k.ErrorAs(err, &s) {
-		return errors.New("Keeper.ErrorAs expected to fail")
+func TestSignatureFormats(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, map[string]interface{}{
+		"type": "ecdsa-p256",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := c.Logical().Read("transit/keys/" + keyID1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode([]byte(secret.Data["keys"].(map[string]interface{})["1"].(map[string]interface{})["public_key"].(string)))
+	if block == nil {
+		t.Fatal("got no PEM public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := NewKey(c, keyID1, nil)
+	input := []byte("message to sign")
+	digest := sha256.Sum256(input)
+
+	for _, test := range []struct {
+		format SignatureFormat
+		// rs returns the r and s of sig, in format.
+		rs func(sig []byte) (r, s *big.Int, err error)
+	}{
+		{SignatureVault, nil},
+		{SignatureDER, func(sig []byte) (*big.Int, *big.Int, error) {
+			var rs struct{ R, S *big.Int }
+			_, err := asn1.Unmarshal(sig, &rs)
+			return rs.R, rs.S, err
+		}},
+		{SignatureJWS, func(sig []byte) (*big.Int, *big.Int, error) {
+			b, err := base64.RawURLEncoding.DecodeString(string(sig))
+			if err != nil || len(b) != 64 {
+				return nil, nil, fmt.Errorf("invalid JWS signature %q (%v)", sig, err)
+			}
+			return new(big.Int).SetBytes(b[:32]), new(big.Int).SetBytes(b[32:]), nil
+		}},
+	} {
+		opts := &SignOptions{SignatureFormat: test.format}
+		sig, err := key.Sign(ctx, input, opts)
+		if err != nil {
+			t.Fatalf("%q: %v", test.format, err)
+		}
+		if test.format == SignatureVault && !bytes.HasPrefix(sig, []byte("vault:v1:")) {
+			t.Errorf("%q: got signature %q, want the Vault format", test.format, sig)
+		}
+		if test.rs != nil {
+			r, s, err := test.rs(sig)
+			if err != nil {
+				t.Fatalf("%q: %v", test.format, err)
+			}
+			if !ecdsa.Verify(pub.(*ecdsa.PublicKey), digest[:], r, s) {
+				t.Errorf("%q: got signature not verifying with the public key", test.format)
+			}
+		}
+		if ok, err := key.Verify(ctx, input, sig, opts); err != nil || !ok {
+			t.Errorf("%q: got %v, %v, want true, nil", test.format, ok, err)
+		}
+		if ok, err := key.Verify(ctx, []byte("other message"), sig, opts); err != nil || ok {
+			t.Errorf("%q: other message: got %v, %v, want false, nil", test.format, ok, err)
+		}
+	}
+
+	_, err = key.Sign(ctx, input, &SignOptions{SignatureFormat: "pem"})
+	if got := gcerrors.Code(err); got != gcerrors.InvalidArgument {
+		t.Errorf("unknown format: got error code %v (%v), want %v", got, err, gcerrors.InvalidArgument)
 	}
-	return nil
 }
 
-// Vault-specific tests.
+func TestSignPrehashed(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
 
-func TestNoSessionProvidedError(t *testing.T) {
-	if _, err := Dial(context.Background(), nil); err == nil {
-		t.Error("got nil, want no auth Config provided")
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, map[string]interface{}{
+		"type": "ecdsa-p256",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	key := NewKey(c, keyID1, nil)
+	content := []byte("large content to sign")
+	digest := sha256.Sum256(content)
+	prehashed := &SignOptions{HashAlgorithm: "sha2-256", Prehashed: true}
+	sig, err := key.Sign(ctx, digest[:], prehashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := key.Verify(ctx, digest[:], sig, prehashed); err != nil || !ok {
+		t.Errorf("prehashed: got %v, %v, want true, nil", ok, err)
+	}
+	if ok, err := key.Verify(ctx, content, sig, &SignOptions{HashAlgorithm: "sha2-256"}); err != nil || !ok {
+		t.Errorf("content: got %v, %v, want true, nil", ok, err)
+	}
+	if _, err := key.Sign(ctx, content, prehashed); err == nil {
+		t.Error("input of the wrong length: got nil, want error")
 	}
 }
 
-func TestNoConnectionError(t *testing.T) {
+func TestSignDerived(t *testing.T) {
 	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
 
-	// Dial calls vault's NewClient method, which doesn't make the connection. Try
-	// doing encryption which should fail by no connection.
-	client, err := Dial(ctx, &Config{
-		Token: "<Client (Root) Token>",
-		APIConfig: api.Config{
-			Address: apiAddress,
-		},
-	})
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, map[string]interface{}{
+		"type":    "ed25519",
+		"derived": true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	key := NewKey(c, keyID1, nil)
+	ctxA := WithDerivationContext(ctx, []byte("A"))
+	ctxB := WithDerivationContext(ctx, []byte("B"))
+	input := []byte("message")
+	sig, err := key.Sign(ctxA, input, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if ok, err := key.Verify(ctxA, input, sig, nil); err != nil || !ok {
+		t.Errorf("verify with the same context: got %v, %v, want true", ok, err)
+	}
+	if ok, err := key.Verify(ctxB, input, sig, nil); err != nil || ok {
+		t.Errorf("verify with another context: got %v, %v, want false", ok, err)
+	}
 
-	keeper := NewKeeper(client, "my-key", nil)
-	if _, err := keeper.Encrypt(ctx, []byte("test")); err == nil {
-		t.Error("got nil, want connection refused")
+	if _, err := c.Logical().Write("transit/keys/"+keyID2, map[string]interface{}{
+		"type": "ed25519",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewKey(c, keyID2, nil).Sign(ctxA, input, nil)
+	if got, want := gcerrors.Code(err), gcerrors.FailedPrecondition; got != want {
+		t.Errorf("sign with a context and a key without derivation: got error code %v, want %v (err: %v)", got, want, err)
+	}
+}
+
+func TestSignUnsupportedKeyType(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	if _, err := c.Logical().Write("transit/keys/"+keyID1, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err := NewKey(c, keyID1, nil).Sign(ctx, []byte("test"), nil)
+	if got, want := gcerrors.Code(err), gcerrors.FailedPrecondition; got != want {
+		t.Errorf("got error code %v, want %v (err: %v)", got, want, err)
 	}
 }
 
@@ -180,6 +2418,21 @@ func TestURLCaching(t *testing.T) {
 			URL:  "vault://mykey?token=bar&address=newaddress",
 			Want: 3,
 		},
+		// New address set.
+		{
+			URL:  "vault://mykey?token=bar&address=newaddress,foo",
+			Want: 4,
+		},
+		// New headers.
+		{
+			URL:  "vault://mykey?token=bar&address=foo&header=X-A:1&header=X-B:2",
+			Want: 5,
+		},
+		// Still cached despite header order change.
+		{
+			URL:  "vault://mykey?token=bar&address=foo&header=X-B:2&header=X-A:1",
+			Want: 5,
+		},
 	}
 
 	ctx := context.Background()
@@ -196,6 +2449,328 @@ func TestURLCaching(t *testing.T) {
 	}
 }
 
+func TestURLCachingEviction(t *testing.T) {
+	ctx := context.Background()
+	o := &lazyDialer{opts: ConnectionOptions{MaxCachedClients: 2}}
+	open := func(token string) *api.Client {
+		u, err := url.Parse("vault://mykey?address=foo&token=" + token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, _, err := o.cachedClient(ctx, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	a := open("a")
+	open("b")
+	// Use "a" so that "b" is the least recently used.
+	if got := open("a"); got != a {
+		t.Error("got a new client for a, want the cached one")
+	}
+	c := open("c")
+	if got, want := len(o.clients), 2; got != want {
+		t.Fatalf("got %d cached clients, want %d", got, want)
+	}
+	if _, ok := o.clients["address=foo,token=b"]; ok {
+		t.Error("got b still cached, want it evicted")
+	}
+	if got := open("a"); got != a {
+		t.Error("got a new client for a, want the cached one")
+	}
+	if got := open("c"); got != c {
+		t.Error("got a new client for c, want the cached one")
+	}
+}
+
+func TestURLCachingTTL(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	o := &lazyDialer{
+		opts: ConnectionOptions{ClientTTL: time.Minute},
+		now:  func() time.Time { return now },
+	}
+	u, err := url.Parse("vault://mykey?address=foo&token=bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _, err := o.cachedClient(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(30 * time.Second)
+	got, _, err := o.cachedClient(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != first {
+		t.Error("got a new client within the TTL, want the cached one")
+	}
+
+	now = now.Add(time.Minute)
+	got, _, err = o.cachedClient(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == first {
+		t.Error("got the cached client after the TTL, want a new one")
+	}
+	if got, want := len(o.clients), 1; got != want {
+		t.Errorf("got %d cached clients, want %d", got, want)
+	}
+}
+
+func TestCloseCachedClients(t *testing.T) {
+	ctx := context.Background()
+	srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		writeCiphertext(w)
+	})
+	defer srv.Close()
+
+	before := runtime.NumGoroutine()
+	o := &lazyDialer{}
+	for i := 0; i < 10; i++ {
+		u, err := url.Parse(fmt.Sprintf("vault://%s?address=%s&token=t%d", keyID1, srv.URL, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keeper, err := o.OpenKeeperURL(ctx, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := keeper.Encrypt(ctx, []byte("test")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.close()
+	if got := len(o.clients); got != 0 {
+		t.Errorf("got %d cached clients after close, want 0", got)
+	}
+	// The goroutines serving the connections exit asynchronously.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > before {
+		t.Errorf("got %d goroutines after close, want at most %d", got, before)
+	}
+}
+
+func TestURLCachingConcurrent(t *testing.T) {
+	ctx := context.Background()
+	o := &lazyDialer{}
+	const n = 50
+	clients := make([]*api.Client, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u, err := url.Parse("vault://mykey?address=foo&token=bar")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c, _, err := o.cachedClient(ctx, u)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			clients[i] = c
+		}(i)
+	}
+	wg.Wait()
+	if got, want := len(o.clients), 1; got != want {
+		t.Fatalf("got %d cached clients, want %d", got, want)
+	}
+	for i, c := range clients {
+		if c != clients[0] {
+			t.Errorf("goroutine %d got a different client", i)
+		}
+	}
+}
+
+func TestURLCachingCanceledDial(t *testing.T) {
+	loggingIn := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		if i == 0 {
+			loggingIn <- struct{}{}
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"auth":{"client_token":"t"}}`)
+	})
+	defer srv.Close()
+
+	o := &lazyDialer{}
+	cfg := &Config{
+		APIConfig: api.Config{Address: srv.URL},
+		Userpass:  &UserpassAuth{Username: "app", Password: "s3cret"},
+	}
+	// The first caller gives up while the shared dial is logging in.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := o.client(ctx, "key", cfg)
+		first <- err
+	}()
+	<-loggingIn
+	second := make(chan error, 1)
+	go func() {
+		_, err := o.client(context.Background(), "key", cfg)
+		second <- err
+	}()
+	// Give the second caller time to join the dial.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("first caller: got %v, want %v", err, context.Canceled)
+	}
+	close(release)
+	if err := <-second; err != nil {
+		t.Errorf("second caller: got %v, want a client", err)
+	}
+	if got, want := len(o.clients), 1; got != want {
+		t.Errorf("got %d cached clients, want %d", got, want)
+	}
+}
+
+func TestKeyInfoCache(t *testing.T) {
+	var reads, lists, rotations int32
+	srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/transit/keys" && r.URL.Query().Get("list") == "true":
+			atomic.AddInt32(&lists, 1)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"data":{"keys":[%q]}}`, keyID1)
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/transit/keys/"+keyID1:
+			atomic.AddInt32(&reads, 1)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"data":{"type":"aes256-gcm96","latest_version":%d}}`, atomic.LoadInt32(&rotations)+1)
+		case r.URL.Path == "/v1/transit/keys/"+keyID1+"/rotate":
+			atomic.AddInt32(&rotations, 1)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusNotFound)
+		}
+	})
+	defer srv.Close()
+
+	ctx := context.Background()
+	client, err := Dial(ctx, &Config{
+		Token:      "<Client (Root) Token>",
+		APIConfig:  api.Config{Address: srv.URL},
+		KeyInfoTTL: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		info, err := ReadKeyInfo(ctx, client, keyID1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.LatestVersion != 1 {
+			t.Errorf("got latest version %d, want 1", info.LatestVersion)
+		}
+	}
+	if got := atomic.LoadInt32(&reads); got != 1 {
+		t.Errorf("got %d reads of the key within the TTL, want 1", got)
+	}
+
+	// Listing the keys is cached too, and does not evict the key metadata.
+	for i := 0; i < 2; i++ {
+		names, err := ListKeys(ctx, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{keyID1}; !reflect.DeepEqual(names, want) {
+			t.Errorf("got keys %v, want %v", names, want)
+		}
+	}
+	if got := atomic.LoadInt32(&lists); got != 1 {
+		t.Errorf("got %d lists of the keys within the TTL, want 1", got)
+	}
+	if _, err := ReadKeyInfo(ctx, client, keyID1); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&reads); got != 1 {
+		t.Errorf("got %d reads of the key after listing the keys, want 1", got)
+	}
+
+	if err := NewKey(client, keyID1, nil).RotateKey(ctx); err != nil {
+		t.Fatal(err)
+	}
+	info, err := ReadKeyInfo(ctx, client, keyID1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LatestVersion != 2 {
+		t.Errorf("got latest version %d after rotating the key, want 2", info.LatestVersion)
+	}
+	if got := atomic.LoadInt32(&reads); got != 2 {
+		t.Errorf("got %d reads of the key, want the rotation to force another", got)
+	}
+}
+
+func TestURLCachingSharedAcrossKeys(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		keys = map[string]bool{}
+	)
+	srv, _ := stubServer(func(i int, w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys[path.Base(r.URL.Path)] = true
+		mu.Unlock()
+		writeCiphertext(w)
+	})
+	defer srv.Close()
+
+	ctx := context.Background()
+	o := &lazyDialer{}
+	const n = 5
+	clients := make([]*api.Client, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u, err := url.Parse(fmt.Sprintf("vault://key%d?address=%s&token=bar", i, url.QueryEscape(srv.URL)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			keeper, err := o.OpenKeeperURL(ctx, u)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !keeper.As(&clients[i]) {
+				t.Error("keeper.As failed")
+			}
+			if _, err := keeper.Encrypt(ctx, []byte("test")); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got := len(o.clients); got != 1 {
+		t.Errorf("got %d clients dialed, want 1", got)
+	}
+	for i, c := range clients {
+		if c != clients[0] {
+			t.Errorf("keeper %d got a different client", i)
+		}
+	}
+	if len(keys) != n {
+		t.Errorf("got encryptions with keys %v, want %d keys", keys, n)
+	}
+}
+
 func TestOpenKeeper(t *testing.T) {
 	tests := []struct {
 		URL     string
@@ -204,6 +2779,9 @@ func TestOpenKeeper(t *testing.T) {
 		{"vault://mykey?token=bar&address=address", false},
 		{"vault://mykey?token=bar&token=token", false},
 		{"vault://mykey?token=bar&address=address&token=token", false},
+		{"vault://mykey?token=bar&header=X-Proxy-Auth:secret", false},
+		{"vault://mykey?token=bar&header=invalid", true},
+		{"vault://mykey?token=bar&header=X-Vault-Token:other", true},
 		{"vault://mykey?token=bar&param=value", true},
 	}
 
@@ -215,3 +2793,151 @@ func TestOpenKeeper(t *testing.T) {
 		}
 	}
 }
+
+func TestRegisterClient(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(t)
+	defer cleanup()
+
+	RegisterClient("test", c)
+	defer RegisterClient("test", nil)
+	keeper, err := secrets.OpenKeeper(ctx, "vault://"+keyID1+"?client=test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got *api.Client
+	if !keeper.As(&got) || got != c {
+		t.Error("got keeper not using the registered client")
+	}
+	ciphertext, err := keeper.Encrypt(ctx, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKeeper(c, keyID1, nil).Decrypt(ctx, ciphertext); err != nil {
+		t.Error(err)
+	}
+
+	for _, u := range []string{
+		"vault://" + keyID1 + "?client=unknown",
+		"vault://" + keyID1 + "?client=test&token=bar",
+	} {
+		if _, err := secrets.OpenKeeper(ctx, u); err == nil {
+			t.Errorf("%s: got nil, want error", u)
+		}
+	}
+}
+
+func TestReadSecret(t *testing.T) {
+	ctx := context.Background()
+	c, cleanup := testVaultServer(t)
+	defer cleanup()
+
+	if err := c.Sys().Mount("kv", &api.MountInput{
+		Type:    "kv",
+		Options: map[string]string{"version": "2"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	writeSecret := func(data map[string]interface{}) {
+		t.Helper()
+		// The engine is briefly unavailable while it sets up its storage after
+		// being mounted.
+		var err error
+		for i := 0; i < 50; i++ {
+			if _, err = c.Logical().Write("kv/data/myapp/db", map[string]interface{}{"data": data}); err == nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatal(err)
+	}
+	v1 := map[string]interface{}{"password": "first"}
+	v2 := map[string]interface{}{"password": "second"}
+	writeSecret(v1)
+	writeSecret(v2)
+
+	got, err := ReadSecret(ctx, c, "kv/myapp/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, v2) {
+		t.Errorf("got latest version %v, want %v", got, v2)
+	}
+	got, err = ReadSecretVersion(ctx, c, "kv/myapp/db", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, v1) {
+		t.Errorf("got version 1 %v, want %v", got, v1)
+	}
+
+	for _, test := range []struct {
+		path    string
+		version int
+		want    gcerrors.ErrorCode
+	}{
+		{"kv/myapp/other", 0, gcerrors.NotFound},
+		{"kv/myapp/db", 3, gcerrors.NotFound},
+		{"kv", 0, gcerrors.InvalidArgument},
+		{"kv/myapp/db", -1, gcerrors.InvalidArgument},
+	} {
+		_, err := ReadSecretVersion(ctx, c, test.path, test.version)
+		if got := gcerrors.Code(err); got != test.want {
+			t.Errorf("%s version %d: got error code %v (%v), want %v", test.path, test.version, got, err, test.want)
+		}
+	}
+}
+
+func BenchmarkVaultEncryptDecrypt(b *testing.B) {
+	ctx := context.Background()
+	c, cleanup := testTransitServer(b)
+	defer cleanup()
+
+	key := NewKey(c, keyID1, nil)
+	keeper := key.Keeper()
+	// A representative payload, such as a data key with some metadata.
+	plaintext := bytes.Repeat([]byte("a"), 1024)
+	ciphertext, err := keeper.Encrypt(ctx, plaintext)
+	if err != nil {
+		b.Fatal(err)
+	}
+	const batchSize = 10
+	var plaintexts, ciphertexts [][]byte
+	for i := 0; i < batchSize; i++ {
+		plaintexts = append(plaintexts, plaintext)
+		ciphertexts = append(ciphertexts, ciphertext)
+	}
+
+	for _, bm := range []struct {
+		name  string
+		bytes int
+		fn    func() error
+	}{
+		{"Encrypt", len(plaintext), func() error {
+			_, err := keeper.Encrypt(ctx, plaintext)
+			return err
+		}},
+		{"Decrypt", len(plaintext), func() error {
+			_, err := keeper.Decrypt(ctx, ciphertext)
+			return err
+		}},
+		{"BatchEncrypt", batchSize * len(plaintext), func() error {
+			_, err := key.BatchEncrypt(ctx, plaintexts)
+			return err
+		}},
+		{"BatchDecrypt", batchSize * len(plaintext), func() error {
+			_, err := key.BatchDecrypt(ctx, ciphertexts)
+			return err
+		}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(int64(bm.bytes))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := bm.fn(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}